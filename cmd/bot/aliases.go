@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Guild aliases are stored in the settings hash as alias.<name>
+	ALIAS_FIELD_PREFIX = "alias."
+
+	// Most aliases a single guild may define
+	MAX_GUILD_ALIASES = 25
+)
+
+var aliasCommand = &Command{
+	Name:  "alias",
+	Usage: "list|add|remove",
+	Help:  "Shows or changes this server's command aliases",
+	Level: LevelUser,
+	Subcommands: []*Command{
+		{
+			Name:  "list",
+			Help:  "Shows this server's command aliases",
+			Level: LevelUser,
+			Run:   runAliasList,
+		},
+		{
+			Name:    "add",
+			Usage:   "<name> <command> [args]",
+			MinArgs: 2,
+			MaxArgs: -1,
+			Help:    "Makes name run a command, e.g. `alias add bruh airhorn echo`",
+			Level:   LevelAdmin,
+			Run:     runAliasAdd,
+		},
+		{
+			Name:    "remove",
+			Usage:   "<name>",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Help:    "Removes an alias",
+			Level:   LevelAdmin,
+			Run:     runAliasRemove,
+		},
+	},
+}
+
+// Returns the names of a guild's aliases in order
+func sortedAliases(settings *GuildSettings) []string {
+	names := make([]string, 0, len(settings.Aliases))
+	for name := range settings.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runAliasList(ctx *CommandContext) {
+	names := sortedAliases(ctx.Settings)
+	if len(names) == 0 {
+		ctx.Reply("This server has no aliases")
+		return
+	}
+
+	prefix := ctx.Settings.Prefix()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("`%s%s` runs `%s%s`", prefix, name, prefix, ctx.Settings.Aliases[name]))
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func runAliasAdd(ctx *CommandContext) {
+	name, line := ctx.Args[0], strings.Join(ctx.Args[1:], " ")
+	for _, prefix := range ctx.Settings.Prefixes {
+		name = strings.TrimPrefix(name, prefix)
+		line = strings.TrimPrefix(line, prefix)
+	}
+
+	if len(name) == 0 || len(name) > 20 {
+		ctx.Reply("Alias names must be up to 20 characters")
+		return
+	}
+
+	if _, exists := commandsByName[name]; exists {
+		ctx.Reply(fmt.Sprintf("`%s` is already a command", name))
+		return
+	}
+
+	// Aliases only run commands, never other aliases, so they can't loop
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+		return
+	}
+
+	if _, exists := commandsByName[fields[0]]; !exists {
+		ctx.Reply(fmt.Sprintf("There's no command named `%s`", fields[0]))
+		return
+	}
+
+	if _, exists := ctx.Settings.Aliases[name]; !exists && len(ctx.Settings.Aliases) >= MAX_GUILD_ALIASES {
+		ctx.Reply(fmt.Sprintf("Servers can have up to %d aliases", MAX_GUILD_ALIASES))
+		return
+	}
+
+	err := storeSetting(ctx.Guild.ID, ALIAS_FIELD_PREFIX+name, line)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": ctx.Guild.ID,
+			"alias": name,
+			"error": err,
+		}).Warning("Failed to store guild alias")
+		ctx.Reply("Failed to save that alias, try again in a bit")
+		return
+	}
+
+	prefix := ctx.Settings.Prefix()
+	ctx.Reply(fmt.Sprintf("`%s%s` now runs `%s%s`", prefix, name, prefix, line))
+}
+
+func runAliasRemove(ctx *CommandContext) {
+	name := ctx.Args[0]
+	for _, prefix := range ctx.Settings.Prefixes {
+		name = strings.TrimPrefix(name, prefix)
+	}
+
+	if _, exists := ctx.Settings.Aliases[name]; !exists {
+		ctx.Reply(fmt.Sprintf("There's no alias named `%s`", name))
+		return
+	}
+
+	err := storeSetting(ctx.Guild.ID, ALIAS_FIELD_PREFIX+name, "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": ctx.Guild.ID,
+			"alias": name,
+			"error": err,
+		}).Warning("Failed to remove guild alias")
+		ctx.Reply("Failed to remove that alias, try again in a bit")
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("Removed `%s`", name))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAliasCommands(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("520000000000000000")
+	text, general := guild.Channels[0].ID, guild.Channels[1].ID
+
+	// Returns the bot's last reply
+	lastReply := func() string {
+		messages := state.fake.Messages()
+		if len(messages) == 0 {
+			return ""
+		}
+		return messages[len(messages)-1].Content
+	}
+
+	for _, content := range []string{"!airhorn alias add help airhorn", "!airhorn alias add bruh nothing"} {
+		state.fake.Send("1", testAdmin, text, content)
+		if aliases := guildSettings(guild.ID).Aliases; len(aliases) != 0 || strings.HasPrefix(lastReply(), "`!") {
+			t.Errorf("%s was accepted: %q", content, lastReply())
+		}
+	}
+
+	state.fake.Send("2", testAdmin, text, "!airhorn alias add !bruh !airhorn echo")
+	if line := guildSettings(guild.ID).Aliases["bruh"]; line != "airhorn echo" {
+		t.Fatalf("Alias runs %q, expected airhorn echo", line)
+	}
+
+	state.fake.Send("3", testUser, text, "!bruh")
+	waitForPlays(t)
+
+	sinks := state.guildSinks(guild.ID)
+	if len(sinks) != 1 || len(sinks[0].joins) != 1 || sinks[0].joins[0] != general {
+		t.Fatalf("Alias played %v, expected one sound in %s", sinks, general)
+	}
+
+	state.fake.Send("4", testUser, text, "!airhorn alias list")
+	if !strings.Contains(lastReply(), "bruh") {
+		t.Errorf("Alias list is %q", lastReply())
+	}
+
+	state.fake.Send("5", testAdmin, text, "!airhorn alias remove bruh")
+	state.fake.Send("6", testUser, text, "!bruh")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Errorf("Removed alias still plays")
+	}
+}
+
+func TestDisabledAliases(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("530000000000000000")
+	text := guild.Channels[0].ID
+
+	// Aliases of a disabled command are disabled too
+	for name, value := range map[string]string{
+		"disabled":                  "johncena",
+		ALIAS_FIELD_PREFIX + "john": "johncena",
+	} {
+		if err := storeSetting(guild.ID, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state.fake.Send("1", testUser, text, "!johncena")
+	state.fake.Send("2", testUser, text, "!john")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("A disabled command was played %d times", len(sinks))
+	}
+}
+
+func TestGuildPrefixes(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("540000000000000000")
+	text := guild.Channels[0].ID
+
+	if err := storeSetting(guild.ID, "prefix", "?,$$"); err != nil {
+		t.Fatal(err)
+	}
+
+	state.fake.Send("1", testUser, text, "!airhorn")
+	waitForPlays(t)
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("The default prefix still works")
+	}
+
+	state.fake.Send("2", testUser, text, "?airhorn")
+	waitForPlays(t)
+	state.fake.Send("3", testUser, text, "$$airhorn")
+	waitForPlays(t)
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 2 {
+		t.Fatalf("Custom prefixes played %d times, expected 2", len(sinks))
+	}
+
+	// Mentioning the bot always works
+	state.fake.Send("4", testUser, text, "<@"+testBot.ID+"> airhorn", testBot)
+	waitForPlays(t)
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 3 {
+		t.Fatalf("Mentioning the bot didn't play")
+	}
+}
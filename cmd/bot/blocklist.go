@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Redis hash holding every block, keyed by <kind>:<id>
+	BLOCKLIST_KEY = "airhorn:blocklist"
+
+	// Redis channel block keys are published on when they change
+	BLOCKLIST_CHANNEL = "airhorn:blocklist"
+
+	// How often the blocklist is reloaded, in case we missed a change
+	BLOCKLIST_REFRESH = time.Minute
+
+	BLOCK_USER  = "user"
+	BLOCK_GUILD = "guild"
+)
+
+// blockEntry is a user or guild the bot ignores
+type blockEntry struct {
+	Kind   string    `json:"kind"`
+	ID     string    `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+
+	// When the block ends, it never does if zero
+	Expires time.Time `json:"expires"`
+
+	// If set, a blocked guild is left instead of ignored
+	Leave bool `json:"leave,omitempty"`
+}
+
+var (
+	// Every current block, keyed by <kind>:<id>
+	blocklist      = make(map[string]*blockEntry)
+	blocklistMutex sync.RWMutex
+)
+
+func blockKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+func (e *blockEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// Returns the block on a user or guild, if there is one
+func findBlock(kind, id string) *blockEntry {
+	blocklistMutex.RLock()
+	entry, exists := blocklist[blockKey(kind, id)]
+	blocklistMutex.RUnlock()
+
+	if !exists || entry.expired(time.Now()) {
+		return nil
+	}
+	return entry
+}
+
+func isBlocked(kind, id string) bool {
+	return findBlock(kind, id) != nil
+}
+
+// Loads every block from redis, dropping the ones that expired
+func loadBlocklist() error {
+	if rcli == nil {
+		return nil
+	}
+
+	values, err := rcli.HGetAllMap(BLOCKLIST_KEY).Result()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entries := make(map[string]*blockEntry)
+	for key, value := range values {
+		entry := &blockEntry{}
+		if json.Unmarshal([]byte(value), entry) != nil || entry.expired(now) {
+			rcli.HDel(BLOCKLIST_KEY, key)
+			continue
+		}
+		entries[key] = entry
+	}
+
+	blocklistMutex.Lock()
+	blocklist = entries
+	blocklistMutex.Unlock()
+
+	leaveBlockedGuilds()
+	return nil
+}
+
+// Stores a block, or removes it if entry is nil, and tells every shard
+func storeBlock(kind, id string, entry *blockEntry) error {
+	key := blockKey(kind, id)
+
+	if rcli != nil {
+		var err error
+		if entry == nil {
+			err = rcli.HDel(BLOCKLIST_KEY, key).Err()
+		} else {
+			data, _ := json.Marshal(entry)
+			err = rcli.HSet(BLOCKLIST_KEY, key, string(data)).Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	blocklistMutex.Lock()
+	if entry == nil {
+		delete(blocklist, key)
+	} else {
+		blocklist[key] = entry
+	}
+	blocklistMutex.Unlock()
+
+	if rcli != nil {
+		rcli.Publish(BLOCKLIST_CHANNEL, key)
+	}
+
+	leaveBlockedGuilds()
+	return nil
+}
+
+// Leaves any guild on our shard that was blocked with leave set
+func leaveBlockedGuilds() {
+	if client == nil {
+		return
+	}
+
+	for _, guild := range client.Guilds() {
+		if shardContains(guild.ID) {
+			leaveIfBlocked(guild.ID)
+		}
+	}
+}
+
+// Leaves a guild if it was blocked with leave set, returns whether it's blocked
+func leaveIfBlocked(guildID string) bool {
+	entry := findBlock(BLOCK_GUILD, guildID)
+	if entry == nil {
+		return false
+	}
+
+	if !entry.Leave {
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"guild":  guildID,
+		"reason": entry.Reason,
+	}).Info("Leaving blocked guild")
+
+	err := client.LeaveGuild(guildID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guildID,
+			"error": err,
+		}).Warning("Failed to leave blocked guild")
+	}
+	return true
+}
+
+// Keeps our copy of the blocklist current until we shut down, reloading it
+// whenever a shard changes it and every BLOCKLIST_REFRESH
+func blocklistLoop() {
+	go func() {
+		for {
+			select {
+			case <-time.After(BLOCKLIST_REFRESH):
+			case <-shutdown:
+				return
+			}
+
+			err := loadBlocklist()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Failed to reload blocklist")
+			}
+		}
+	}()
+
+	pubsub, err := rcli.Subscribe(BLOCKLIST_CHANNEL)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to subscribe to blocklist channel")
+		return
+	}
+
+	go func() {
+		<-shutdown
+		pubsub.Close()
+	}()
+
+	for {
+		_, err := pubsub.ReceiveMessage()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to receive blocklist change")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		err = loadBlocklist()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to reload blocklist")
+		}
+	}
+}
+
+// Parses a block duration like 30m, 12h, 7d or 2w
+func parseBlockDuration(value string) (time.Duration, bool) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	if unit != 0 {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil || n < 1 {
+			return 0, false
+		}
+		return time.Duration(n) * unit, true
+	}
+
+	d, err := time.ParseDuration(value)
+	return d, err == nil && d > 0
+}
+
+// Accepts a raw ID or a user mention
+func parseBlockID(value string) string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "<@"), ">")
+	return strings.TrimPrefix(value, "!")
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "block",
+		Usage:   "user|guild <id> [duration] [leave] [reason]",
+		MinArgs: 2,
+		MaxArgs: -1,
+		Help:    "Ignores a user or guild, forever or for a duration like 12h or 7d, leave makes us leave a guild",
+		Level:   LevelOwner,
+		Run:     runBlock,
+	})
+
+	registerCommand(&Command{
+		Name:    "unblock",
+		Usage:   "user|guild <id>",
+		MinArgs: 2,
+		MaxArgs: 2,
+		Help:    "Removes a block",
+		Level:   LevelOwner,
+		Run:     runUnblock,
+	})
+
+	registerCommand(&Command{
+		Name:  "blocks",
+		Help:  "Lists blocked users and guilds",
+		Level: LevelOwner,
+		Run:   runBlocks,
+	})
+}
+
+func runBlock(ctx *CommandContext) {
+	kind, id := ctx.Args[0], parseBlockID(ctx.Args[1])
+	if kind != BLOCK_USER && kind != BLOCK_GUILD {
+		ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+		return
+	}
+
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		ctx.Reply(fmt.Sprintf("`%s` isn't an ID", ctx.Args[1]))
+		return
+	}
+
+	if kind == BLOCK_USER && isOwner(id) {
+		ctx.Reply("Owners can't be blocked")
+		return
+	}
+
+	entry := &blockEntry{
+		Kind: kind,
+		ID:   id,
+		By:   ctx.Message.Author.ID,
+		At:   time.Now(),
+	}
+
+	rest := ctx.RawArgs()[2:]
+	if len(rest) > 0 {
+		if d, ok := parseBlockDuration(strings.ToLower(rest[0])); ok {
+			entry.Expires = entry.At.Add(d)
+			rest = rest[1:]
+		}
+	}
+
+	if kind == BLOCK_GUILD && len(rest) > 0 && strings.ToLower(rest[0]) == "leave" {
+		entry.Leave = true
+		rest = rest[1:]
+	}
+	entry.Reason = strings.Join(rest, " ")
+
+	err := storeBlock(kind, id, entry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"kind":  kind,
+			"id":    id,
+			"error": err,
+		}).Warning("Failed to store block")
+		ctx.Reply("Failed to save that block, try again in a bit")
+		return
+	}
+
+	until := "forever"
+	if !entry.Expires.IsZero() {
+		until = "until " + entry.Expires.UTC().Format("2006-01-02 15:04 MST")
+	}
+	ctx.Reply(fmt.Sprintf("Blocked %s %s %s", kind, id, until))
+}
+
+func runUnblock(ctx *CommandContext) {
+	kind, id := ctx.Args[0], parseBlockID(ctx.Args[1])
+	if kind != BLOCK_USER && kind != BLOCK_GUILD {
+		ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+		return
+	}
+
+	if !isBlocked(kind, id) {
+		ctx.Reply(fmt.Sprintf("%s %s isn't blocked", kind, id))
+		return
+	}
+
+	err := storeBlock(kind, id, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"kind":  kind,
+			"id":    id,
+			"error": err,
+		}).Warning("Failed to remove block")
+		ctx.Reply("Failed to remove that block, try again in a bit")
+		return
+	}
+	ctx.Reply(fmt.Sprintf("Unblocked %s %s", kind, id))
+}
+
+func runBlocks(ctx *CommandContext) {
+	now := time.Now()
+
+	blocklistMutex.RLock()
+	entries := make([]*blockEntry, 0, len(blocklist))
+	for _, entry := range blocklist {
+		if !entry.expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+	blocklistMutex.RUnlock()
+
+	if len(entries) == 0 {
+		ctx.Reply("Nobody is blocked")
+		return
+	}
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "Kind\tID\tUntil\tLeave\tReason\n")
+	for _, entry := range entries {
+		until := "forever"
+		if !entry.Expires.IsZero() {
+			until = entry.Expires.UTC().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", entry.Kind, entry.ID, until, entry.Leave, entry.Reason)
+	}
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	ctx.Reply(buf.String())
+}
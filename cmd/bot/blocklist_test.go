@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Empties the blocklist for the length of a test
+func setupTestBlocklist(t *testing.T) {
+	blocklistMutex.Lock()
+	old := blocklist
+	blocklist = make(map[string]*blockEntry)
+	blocklistMutex.Unlock()
+
+	t.Cleanup(func() {
+		blocklistMutex.Lock()
+		blocklist = old
+		blocklistMutex.Unlock()
+	})
+}
+
+func TestParseBlockDuration(t *testing.T) {
+	cases := []struct {
+		value    string
+		duration time.Duration
+		valid    bool
+	}{
+		{"30m", 30 * time.Minute, true},
+		{"12h", 12 * time.Hour, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"spam", 0, false},
+		{"xd", 0, false},
+	}
+
+	for _, c := range cases {
+		d, ok := parseBlockDuration(c.value)
+		if ok != c.valid || (ok && d != c.duration) {
+			t.Errorf("%q parsed as %s (%v), expected %s (%v)", c.value, d, ok, c.duration, c.valid)
+		}
+	}
+}
+
+func TestBlockCommands(t *testing.T) {
+	state := setupTestBot(t)
+	setupTestBlocklist(t)
+	guild := state.addGuild("580000000000000000")
+	text := guild.Channels[0].ID
+
+	// Returns the bot's last reply
+	lastReply := func() string {
+		messages := state.fake.Messages()
+		if len(messages) == 0 {
+			return ""
+		}
+		return messages[len(messages)-1].Content
+	}
+
+	state.fake.Send("1", testOwner, text, "!block user <@"+testOwner.ID+">")
+	if isBlocked(BLOCK_USER, testOwner.ID) {
+		t.Fatalf("An owner was blocked")
+	}
+
+	state.fake.Send("2", testOwner, text, "!block user <@!"+testUser.ID+"> 1h Spamming Sounds")
+	entry := findBlock(BLOCK_USER, testUser.ID)
+	if entry == nil || entry.Reason != "Spamming Sounds" || entry.By != testOwner.ID ||
+		entry.Expires.Sub(entry.At) != time.Hour {
+		t.Fatalf("Block is %+v, expected one hour for spamming sounds", entry)
+	}
+
+	state.fake.Send("3", testUser, text, "!airhorn")
+	waitForPlays(t)
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("A blocked user played a sound")
+	}
+
+	state.fake.Send("4", testOwner, text, "!blocks")
+	if reply := lastReply(); !strings.Contains(reply, testUser.ID) || !strings.Contains(reply, "Spamming Sounds") {
+		t.Errorf("Block list is %q", reply)
+	}
+
+	state.fake.Send("5", testOwner, text, "!unblock user "+testUser.ID)
+	state.fake.Send("6", testUser, text, "!airhorn")
+	waitForPlays(t)
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Fatalf("An unblocked user played %d sounds, expected 1", len(sinks))
+	}
+}
+
+func TestBlockExpires(t *testing.T) {
+	setupTestBlocklist(t)
+
+	now := time.Now()
+	storeBlock(BLOCK_USER, "1", &blockEntry{Kind: BLOCK_USER, ID: "1", At: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)})
+	storeBlock(BLOCK_USER, "2", &blockEntry{Kind: BLOCK_USER, ID: "2", At: now})
+
+	if isBlocked(BLOCK_USER, "1") {
+		t.Error("Expired block still applies")
+	}
+
+	if !isBlocked(BLOCK_USER, "2") {
+		t.Error("Block without an expiry doesn't apply")
+	}
+}
+
+func TestBlockGuildLeave(t *testing.T) {
+	state := setupTestBot(t)
+	setupTestBlocklist(t)
+	ignored := state.addGuild("590000000000000000")
+	left := state.addGuild("600000000000000000")
+
+	// Even owners' messages from a blocked guild are dropped, so it's blocked last
+	state.fake.Send("1", testOwner, ignored.Channels[0].ID, "!block guild "+left.ID+" 7d leave raids")
+	state.fake.Send("2", testOwner, ignored.Channels[0].ID, "!block guild "+ignored.ID)
+
+	guilds := make(map[string]bool)
+	for _, guild := range state.fake.Guilds() {
+		guilds[guild.ID] = true
+	}
+
+	if !guilds[ignored.ID] || guilds[left.ID] {
+		t.Errorf("In guilds %v, expected to only leave %s", guilds, left.ID)
+	}
+
+	if entry := findBlock(BLOCK_GUILD, left.ID); entry == nil || !entry.Leave || entry.Reason != "raids" {
+		t.Errorf("Leave block is %+v", entry)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,14 +12,17 @@ import (
 	"os/exec"
 	"os/signal"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
+	"github.com/hammerandchisel/airhornbot/plays"
+	"github.com/hammerandchisel/airhornbot/stats"
 	"github.com/layeh/gopus"
 	redis "gopkg.in/redis.v3"
 )
@@ -27,21 +31,33 @@ var (
 	// discordgo session
 	discord *discordgo.Session
 
+	// Client the bot's logic uses to talk to discord
+	client Client
+
 	// Redis client connection (used for stats)
 	rcli *redis.Client
 
-	// Map of Guild id's to *Play channels, used for queuing and rate-limiting guilds
-	queues map[string]chan *Play = make(map[string]chan *Play)
+	// Where stats are kept, redis unless configured otherwise
+	statsStore stats.Store
+
+	// Map of Guild id's to *PlayQueue's, used for queuing and rate-limiting guilds
+	queues      map[string]*PlayQueue = make(map[string]*PlayQueue)
+	queuesMutex sync.Mutex
 
 	// Sound encoding settings
 	BITRATE        = 128
 	MAX_QUEUE_SIZE = 6
 
-	// Owner
-	OWNER string
+	// If true, forced plays are played before random plays of the same priority
+	FORCED_FIRST bool
+)
 
-	// Shard (or -1)
-	SHARDS []string = make([]string, 0)
+// Reasons a play was dropped, shown to guilds that want feedback
+var (
+	errNotInVoice   = errors.New("Join a voice channel first, or name one to play in")
+	errCannotTarget = errors.New("You need the Move Members permission or a target role to play in a channel you're not in")
+	errCannotPlay   = errors.New("I need permission to connect and speak in that channel")
+	errQueueFull    = errors.New("The queue is full, try again in a bit")
 )
 
 // Play represents an individual use of the !airhorn command
@@ -51,11 +67,20 @@ type Play struct {
 	UserID    string
 	Sound     *Sound
 
+	// The collection the sound belongs to
+	Collection *SoundCollection
+
 	// The next play to occur after this, only used for chaining sounds like anotha
 	Next *Play
 
 	// If true, this was a forced play using a specific airhorn sound name
 	Forced bool
+
+	// The queue lane this play waits in
+	Priority Priority
+
+	// When the play was asked for
+	Requested time.Time
 }
 
 type SoundCollection struct {
@@ -196,7 +221,10 @@ func createSound(Name string, Weight int, PartDelay int) *Sound {
 func (sc *SoundCollection) Load() {
 	for _, sound := range sc.Sounds {
 		sc.soundRange += sound.Weight
+
+		start := time.Now()
 		sound.Load(sc)
+		soundLoadSeconds.WithLabelValues(sc.Prefix).Observe(time.Since(start).Seconds())
 	}
 }
 
@@ -290,13 +318,15 @@ func (s *Sound) Load(c *SoundCollection) error {
 	}
 }
 
-// Plays this sound over the specified VoiceConnection
-func (s *Sound) Play(vc *discordgo.VoiceConnection) {
-	vc.Speaking(true)
-	defer vc.Speaking(false)
+// Plays this sound over the specified VoiceSink
+func (s *Sound) Play(sink VoiceSink) {
+	sink.Speaking(true)
+	defer sink.Speaking(false)
 
 	for _, buff := range s.buffer {
-		vc.OpusSend <- buff
+		if err := sink.Send(buff); err != nil {
+			return
+		}
 	}
 }
 
@@ -304,26 +334,64 @@ func (s *Sound) Play(vc *discordgo.VoiceConnection) {
 func getCurrentVoiceChannel(user *discordgo.User, guild *discordgo.Guild) *discordgo.Channel {
 	for _, vs := range guild.VoiceStates {
 		if vs.UserID == user.ID {
-			channel, _ := discord.State.Channel(vs.ChannelID)
+			channel, _ := client.Channel(vs.ChannelID)
 			return channel
 		}
 	}
 	return nil
 }
 
-// Whether a guild id is in this shard
-func shardContains(guildid string) bool {
-	if len(SHARDS) != 0 {
-		ok := false
-		for _, shard := range SHARDS {
-			if len(guildid) >= 5 && string(guildid[len(guildid)-5]) == shard {
-				ok = true
-				break
-			}
+// Attempts to find a voice channel inside a given guild from a channel mention or name
+func findVoiceChannel(ref string, guild *discordgo.Guild) *discordgo.Channel {
+	if strings.HasPrefix(ref, "<#") && strings.HasSuffix(ref, ">") {
+		channel, _ := client.Channel(ref[2 : len(ref)-1])
+		if channel == nil || channel.GuildID != guild.ID || channel.Type != "voice" {
+			return nil
+		}
+		return channel
+	}
+
+	name := strings.TrimPrefix(ref, "#")
+	for _, channel := range guild.Channels {
+		if channel.Type == "voice" && strings.ToLower(channel.Name) == name {
+			return channel
 		}
-		return ok
 	}
-	return true
+	return nil
+}
+
+// Whether a user may play sounds into a voice channel, anyone may play into the
+// one they're in. Other channels need the MOVE_MEMBERS permission on the
+// channel or one of the guild's target roles.
+func canTargetChannel(user *discordgo.User, guild *discordgo.Guild, channel *discordgo.Channel) bool {
+	if isOwner(user.ID) {
+		return true
+	}
+
+	if current := getCurrentVoiceChannel(user, guild); current != nil && current.ID == channel.ID {
+		return true
+	}
+
+	if hasAnyRole(memberRoles(guild.ID, user.ID), guildSettings(guild.ID).TargetRoles) {
+		return true
+	}
+
+	perms, err := client.UserChannelPermissions(user.ID, channel.ID)
+	if err != nil {
+		return false
+	}
+	return perms&discordgo.PermissionVoiceMoveMembers != 0
+}
+
+// Whether the bot has permission to connect and speak in a voice channel
+func botCanPlayIn(channel *discordgo.Channel) bool {
+	required := discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak
+
+	perms, err := client.UserChannelPermissions(client.User().ID, channel.ID)
+	if err != nil {
+		return false
+	}
+	return perms&required == required
 }
 
 // Returns a random integer between min and max
@@ -332,141 +400,253 @@ func randomRange(min, max int) int {
 	return rand.Intn(max-min) + min
 }
 
-// Prepares and enqueues a play into the ratelimit/buffer guild queue
-func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) {
-	// Grab the users voice channel
-	channel := getCurrentVoiceChannel(user, guild)
+// Prepares and enqueues a play into the ratelimit/buffer guild queue, if target
+// is nil the sound is played in the users current voice channel. If allowed
+// is given, random and chained sounds are only picked from the ones it allows.
+// Returns an error explaining why if the play was dropped.
+func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound, allowed func(*SoundCollection, *Sound) bool, priority Priority, target *discordgo.Channel) error {
+	// Grab the users voice channel, unless they asked for a specific one
+	channel := target
+	if channel == nil {
+		channel = getCurrentVoiceChannel(user, guild)
+	} else if !canTargetChannel(user, guild, channel) {
+		log.WithFields(log.Fields{
+			"user":    user.ID,
+			"guild":   guild.ID,
+			"channel": channel.ID,
+		}).Warning("User is not allowed to target voice channel")
+		return errCannotTarget
+	}
+
 	if channel == nil {
 		log.WithFields(log.Fields{
 			"user":  user.ID,
 			"guild": guild.ID,
 		}).Warning("Failed to find channel to play sound in")
-		return
+		return errNotInVoice
+	}
+
+	// Respect the guild's voice channel lists
+	if !guildSettings(guild.ID).VoiceChannelAllowed(channel.ID) {
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": channel.ID,
+		}).Info("Voice channel is blocked by guild settings")
+		return errVoiceChannelBlocked
+	}
+
+	// Nobody gets to horn people who opted out
+	if !optoutsAllow(user.ID, guild, channel) {
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": channel.ID,
+		}).Info("Voice channel has opted out members")
+		return errOptedOut
+	}
+
+	// Make sure we can actually join and speak in the channel
+	if !botCanPlayIn(channel) {
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": channel.ID,
+		}).Warning("Missing permissions to play sound in channel")
+		return errCannotPlay
 	}
 
 	// Create the play
 	play := &Play{
-		GuildID:   guild.ID,
-		ChannelID: channel.ID,
-		UserID:    user.ID,
-		Sound:     sound,
-		Forced:    true,
+		GuildID:    guild.ID,
+		ChannelID:  channel.ID,
+		UserID:     user.ID,
+		Sound:      sound,
+		Collection: coll,
+		Forced:     true,
+		Priority:   priority,
+		Requested:  time.Now(),
 	}
 
 	// If we didn't get passed a manual sound, generate a random one
 	if play.Sound == nil {
-		play.Sound = coll.Random()
+		play.Sound = randomAllowed(coll, allowed)
 		play.Forced = false
 	}
 
-	// If the collection is a chained one, set the next sound
+	if play.Sound == nil {
+		return errSoundNotAllowed
+	}
+
+	// If the collection is a chained one, set the next sound, skipping the
+	// chain if the user may not play any of its sounds
 	if coll.ChainWith != nil {
-		play.Next = &Play{
-			GuildID:   play.GuildID,
-			ChannelID: play.ChannelID,
-			UserID:    play.UserID,
-			Sound:     coll.ChainWith.Random(),
-			Forced:    play.Forced,
+		if next := randomAllowed(coll.ChainWith, allowed); next != nil {
+			play.Next = &Play{
+				GuildID:    play.GuildID,
+				ChannelID:  play.ChannelID,
+				UserID:     play.UserID,
+				Sound:      next,
+				Collection: coll.ChainWith,
+				Forced:     play.Forced,
+				Priority:   play.Priority,
+				Requested:  play.Requested,
+			}
 		}
 	}
 
-	// Check if we already have a connection to this guild
-	//   yes, this isn't threadsafe, but its "OK" 99% of the time
-	_, exists := queues[guild.ID]
+	// Check if we already have a connection to this guild, pushing while we
+	// hold the lock so the play loop can't drop the queue under us
+	size := guildSettings(guild.ID).QueueSize
+	queuesMutex.Lock()
+	queue, exists := queues[guild.ID]
 
 	if exists {
-		if len(queues[guild.ID]) < MAX_QUEUE_SIZE {
-			queues[guild.ID] <- play
+		pushed := queue.Push(play, size)
+		queuesMutex.Unlock()
+		if !pushed {
+			log.WithFields(log.Fields{
+				"guild":    guild.ID,
+				"priority": play.Priority,
+			}).Warning("Guild queue is full, dropping play")
+			return errQueueFull
 		}
 	} else {
-		queues[guild.ID] = make(chan *Play, MAX_QUEUE_SIZE)
+		queues[guild.ID] = NewPlayQueue(FORCED_FIRST)
+		queuesMutex.Unlock()
 		playSound(play, nil)
 	}
+	return nil
 }
 
-func trackSoundStats(play *Play) {
-	if rcli == nil {
-		return
+// Picks a random sound from a collection, only out of the allowed ones if
+// allowed is given
+func randomAllowed(coll *SoundCollection, allowed func(*SoundCollection, *Sound) bool) *Sound {
+	if allowed == nil {
+		return coll.Random()
 	}
+	return coll.RandomWhere(func(sound *Sound) bool { return allowed(coll, sound) })
+}
 
-	_, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
-		var baseChar string
-
-		if play.Forced {
-			baseChar = "f"
-		} else {
-			baseChar = "a"
-		}
-
-		base := fmt.Sprintf("airhorn:%s", baseChar)
-		pipe.Incr("airhorn:total")
-		pipe.Incr(fmt.Sprintf("%s:total", base))
-		pipe.Incr(fmt.Sprintf("%s:sound:%s", base, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:user:%s:sound:%s", base, play.UserID, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:guild:%s:sound:%s", base, play.GuildID, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:guild:%s:chan:%s:sound:%s", base, play.GuildID, play.ChannelID, play.Sound.Name))
-		pipe.SAdd(fmt.Sprintf("%s:users", base), play.UserID)
-		pipe.SAdd(fmt.Sprintf("%s:guilds", base), play.GuildID)
-		pipe.SAdd(fmt.Sprintf("%s:channels", base), play.ChannelID)
-		return nil
+func trackSoundStats(play *Play) {
+	err := stats.Track(statsStore, &stats.PlayRecord{
+		Time:       time.Now(),
+		GuildID:    play.GuildID,
+		ChannelID:  play.ChannelID,
+		UserID:     play.UserID,
+		Collection: play.Collection.Prefix,
+		Sound:      play.Sound.Name,
+		Priority:   play.Priority.String(),
+		Forced:     play.Forced,
 	})
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-		}).Warning("Failed to track stats in redis")
+		}).Warning("Failed to track stats")
 	}
 }
 
+// Opens the stats store, by default in redis if we have it and otherwise in
+// memory
+func openStatsStore(spec string) (err error) {
+	if spec == "" && rcli != nil {
+		spec = "redis"
+	} else if spec == "" {
+		log.Warning("No redis connection, keeping stats in memory until the bot exits")
+		spec = "memory"
+	}
+
+	statsStore, err = stats.Open(spec, rcli)
+	return err
+}
+
+// Copies every stat into another store
+func migrateStats(spec string) error {
+	target, err := stats.Open(spec, nil)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	n, err := stats.Migrate(statsStore, target)
+	log.WithFields(log.Fields{
+		"target": spec,
+		"keys":   n,
+	}).Info("Copied stats")
+	return err
+}
+
 // Play a sound
-func playSound(play *Play, vc *discordgo.VoiceConnection) (err error) {
+func playSound(play *Play, sink VoiceSink) (err error) {
 	log.WithFields(log.Fields{
 		"play": play,
 	}).Info("Playing sound")
 
-	if vc == nil {
-		vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
-		// vc.Receive = false
+	if sink == nil {
+		sink = openVoiceSink(play.GuildID)
+	}
+
+	// Join the channel, or change channels if we need to
+	if sink.ChannelID() != play.ChannelID {
+		start := time.Now()
+		err = sink.Join(play.ChannelID)
 		if err != nil {
+			voiceJoinFailures.Inc()
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("Failed to play sound")
+			queuesMutex.Lock()
 			delete(queues, play.GuildID)
+			queuesMutex.Unlock()
+			closeVoiceSink(play.GuildID, sink)
 			return err
 		}
+		voiceJoinSeconds.Observe(time.Since(start).Seconds())
 	}
 
-	// If we need to change channels, do that now
-	if vc.ChannelID != play.ChannelID {
-		vc.ChangeChannel(play.ChannelID, false, false)
-		time.Sleep(time.Millisecond * 125)
-	}
+	// Play the sound, followed by any sounds chained to it
+	last := play
+	for p, chain := play, 0; p != nil; p, chain = p.Next, chain+1 {
+		playsCounter.WithLabelValues(p.Collection.Prefix, p.Sound.Name).Inc()
 
-	// Track stats for this play in redis
-	go trackSoundStats(play)
+		// Sleep for a specified amount of time before playing the sound
+		time.Sleep(time.Millisecond * 32)
 
-	// Sleep for a specified amount of time before playing the sound
-	time.Sleep(time.Millisecond * 32)
+		// Track stats for this play, and publish it for anyone following plays
+		statsWG.Add(1)
+		go func(p *Play, chain int, started time.Time) {
+			defer statsWG.Done()
+			trackSoundStats(p)
+			publishPlay(p, chain, started)
+		}(p, chain, time.Now())
 
-	// Play the sound
-	play.Sound.Play(vc)
-
-	// If this is chained, play the chained sound
-	if play.Next != nil {
-		playSound(play.Next, vc)
+		p.Sound.Play(sink)
+		last = p
 	}
 
 	// If there is another song in the queue, recurse and play that
-	if len(queues[play.GuildID]) > 0 {
-		play := <-queues[play.GuildID]
-		playSound(play, vc)
-		return nil
+	queuesMutex.Lock()
+	queue, exists := queues[play.GuildID]
+	queuesMutex.Unlock()
+
+	if exists && !isShutdownExpired() {
+		if next := queue.Pop(); next != nil {
+			return playSound(next, sink)
+		}
 	}
 
-	// If the queue is empty, delete it
-	time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
+	time.Sleep(time.Millisecond * time.Duration(last.Sound.PartDelay))
+
+	// Anything pushed while we slept still gets played, otherwise the queue
+	// is empty and can be deleted
+	queuesMutex.Lock()
+	if exists && !isShutdownExpired() {
+		if next := queue.Pop(); next != nil {
+			queuesMutex.Unlock()
+			return playSound(next, sink)
+		}
+	}
 	delete(queues, play.GuildID)
-	vc.Disconnect()
+	queuesMutex.Unlock()
+	closeVoiceSink(play.GuildID, sink)
 	return nil
 }
 
@@ -476,17 +656,31 @@ func onReady(s *discordgo.Session, event *discordgo.Ready) {
 }
 
 func onGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
-	if !shardContains(event.Guild.ID) {
+	handleGuildCreate(event.Guild)
+}
+
+func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	handleMessage(m.Message)
+}
+
+func handleGuildCreate(guild *discordgo.Guild) {
+	if !shardContains(guild.ID) {
 		return
 	}
 
-	if event.Guild.Unavailable != nil {
+	if guild.Unavailable != nil {
 		return
 	}
 
-	for _, channel := range event.Guild.Channels {
-		if channel.ID == event.Guild.ID {
-			s.ChannelMessageSend(channel.ID, "**AIRHORN BOT READY FOR HORNING. TYPE `!AIRHORN` WHILE IN A VOICE CHANNEL TO ACTIVATE**")
+	// Don't greet blocked guilds, and leave them if we were asked to
+	if leaveIfBlocked(guild.ID) {
+		return
+	}
+
+	for _, channel := range guild.Channels {
+		if channel.ID == guild.ID {
+			prefix := strings.ToUpper(guildSettings(guild.ID).Prefix())
+			client.SendMessage(channel.ID, "**AIRHORN BOT READY FOR HORNING. TYPE `"+prefix+"AIRHORN` WHILE IN A VOICE CHANNEL TO ACTIVATE**")
 			return
 		}
 	}
@@ -501,23 +695,73 @@ func scontains(key string, options ...string) bool {
 	return false
 }
 
-func calculateAirhornsPerSecond(cid string) {
-	current, _ := strconv.Atoi(rcli.Get("airhorn:a:total").Val())
-	time.Sleep(time.Second * 10)
-	latest, _ := strconv.Atoi(rcli.Get("airhorn:a:total").Val())
+func displayAirhornsPerSecond(cid string) {
+	throughput, err := stats.LoadThroughput(statsStore, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to load APS")
+		client.SendMessage(cid, "Failed to load APS, try again in a bit")
+		return
+	}
 
-	discord.ChannelMessageSend(cid, fmt.Sprintf("Current APS: %v", (float64(latest-current))/10.0))
+	msg := fmt.Sprintf("Current APS: %.2f (over the last %d minutes)\nPeak APS: %.2f", throughput.APS, stats.APS_WINDOW, throughput.Peak)
+	if throughput.Peak > 0 {
+		msg += fmt.Sprintf(" (at %s)", throughput.PeakAt.Format("2006-01-02 15:04 UTC"))
+	}
+	client.SendMessage(cid, msg)
+}
+
+// Returns the number of queued plays per priority across all guild queues
+func queuedPlays() (guilds int, lengths [numPriorities]int) {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+
+	for _, queue := range queues {
+		for p, n := range queue.Lengths() {
+			lengths[p] += n
+		}
+	}
+	return len(queues), lengths
+}
+
+// Formats per-priority queue lengths for display
+func formatQueueLengths(lengths [numPriorities]int) string {
+	parts := make([]string, 0, numPriorities)
+	for p, n := range lengths {
+		parts = append(parts, fmt.Sprintf("%s %d", Priority(p), n))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func displayQueues(cid string, g *discordgo.Guild) {
+	guilds, lengths := queuedPlays()
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 0, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "Active Queues: \t%d\n", guilds)
+	fmt.Fprintf(w, "Queued: \t%s\n", formatQueueLengths(lengths))
+
+	queuesMutex.Lock()
+	queue, exists := queues[g.ID]
+	queuesMutex.Unlock()
+	if exists {
+		fmt.Fprintf(w, "This Server: \t%s\n", formatQueueLengths(queue.Lengths()))
+	}
+
+	fmt.Fprintf(w, "Forced First: \t%v\n", FORCED_FIRST)
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	client.SendMessage(cid, buf.String())
 }
 
 func displayBotStats(cid string) {
 	stats := runtime.MemStats{}
 	runtime.ReadMemStats(&stats)
 
-	users := 0
-	for _, guild := range discord.State.Ready.Guilds {
-		users += len(guild.Members)
-	}
-
 	w := &tabwriter.Writer{}
 	buf := &bytes.Buffer{}
 
@@ -526,47 +770,159 @@ func displayBotStats(cid string) {
 	fmt.Fprintf(w, "Discordgo: \t%s\n", discordgo.VERSION)
 	fmt.Fprintf(w, "Go: \t%s\n", runtime.Version())
 	fmt.Fprintf(w, "Memory: \t%s / %s (%s total allocated)\n", humanize.Bytes(stats.Alloc), humanize.Bytes(stats.Sys), humanize.Bytes(stats.TotalAlloc))
-	fmt.Fprintf(w, "Tasks: \t%d\n", runtime.NumGoroutine())
-	fmt.Fprintf(w, "Servers: \t%d\n", len(discord.State.Ready.Guilds))
-	fmt.Fprintf(w, "Users: \t%d\n", users)
-	fmt.Fprintf(w, "Shards: \t%s\n", strings.Join(SHARDS, ", "))
+	fmt.Fprintf(w, "Shards: \t%s\n", shardDescription())
+	_, lengths := queuedPlays()
+	fmt.Fprintf(w, "Queued: \t%s\n", formatQueueLengths(lengths))
+	fmt.Fprintf(w, "\n")
+	w.Flush()
+
+	// Every shard's numbers, in their own table so the columns line up
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	formatShardHealth(w, gatherShardHealthOrLocal())
 	fmt.Fprintf(w, "```\n")
 	w.Flush()
-	discord.ChannelMessageSend(cid, buf.String())
+	client.SendMessage(cid, buf.String())
 }
 
-// Handles bot operator messages, should be refactored (lmao)
-func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) {
-	ourShard := shardContains(g.ID)
+// Plays a sound from a collection, ctx.Args optionally names the sound followed
+// by the voice channel to play it in
+func playCollection(ctx *CommandContext, coll *SoundCollection) {
+	if !ctx.Settings.CollectionEnabled(coll) {
+		ctx.Feedback(fmt.Sprintf("`%s` is turned off in this server", ctx.Invoked))
+		return
+	}
 
-	if scontains(parts[len(parts)-1], "stats") && ourShard {
-		displayBotStats(m.ChannelID)
-	} else if scontains(parts[len(parts)-1], "status") {
-		guilds := 0
-		for _, guild := range s.State.Ready.Guilds {
-			if shardContains(guild.ID) {
-				guilds += 1
+	// If they passed a specific sound effect, find and select that
+	var sound *Sound
+	args := ctx.Args
+	if len(args) > 0 {
+		for _, s := range coll.Sounds {
+			if args[0] == s.Name {
+				sound = s
 			}
 		}
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
-			"Shard %v contains %v servers",
-			strings.Join(SHARDS, ","),
-			guilds))
-	} else if scontains(parts[len(parts)-1], "aps") && ourShard {
-		s.ChannelMessageSend(m.ChannelID, ":ok_hand: give me a sec m8")
-		go calculateAirhornsPerSecond(m.ChannelID)
+
+		if sound != nil {
+			args = args[1:]
+		}
+	}
+
+	// Anything left over names the voice channel to play in (otherwise play nothing)
+	var target *discordgo.Channel
+	if len(args) > 0 {
+		target = findVoiceChannel(strings.Join(args, " "), ctx.Guild)
+		if target == nil {
+			ctx.Feedback(fmt.Sprintf("There's no voice channel `%s`", strings.Join(args, " ")))
+			return
+		}
+	}
+
+	user, guild := ctx.Message.Author, ctx.Guild
+	priority := PriorityUser
+	if ctx.Level >= LevelAdmin {
+		priority = PriorityAdmin
+	}
+
+	// Admins skip the guild's role rules and rate limits
+	var allowed func(*SoundCollection, *Sound) bool
+	refund := func() {}
+	if ctx.Level < LevelAdmin {
+		settings, roles := ctx.Settings, ctx.Roles
+		if !settings.CollectionAllowed(roles, coll) {
+			countDroppedPlay(errSoundNotAllowed)
+			ctx.Feedback(fmt.Sprintf("`%s` is limited to some roles in this server", ctx.Invoked))
+			return
+		}
+
+		if sound != nil && !settings.SoundAllowed(roles, coll, sound) {
+			countDroppedPlay(errSoundNotAllowed)
+			ctx.Feedback(fmt.Sprintf("`%s` is limited to some roles in this server", sound.Name))
+			return
+		}
+
+		allowed = func(coll *SoundCollection, sound *Sound) bool {
+			return settings.SoundAllowed(roles, coll, sound)
+		}
+
+		if !allowPlayRate(guild.ID, user.ID, settings.MemberTier(roles)) {
+			countDroppedPlay(errRateLimited)
+			ctx.Feedback(errRateLimited.Error())
+			return
+		}
+
+		// Plays that never happen don't count against the cooldown
+		refund = func() {
+			refundPlayRate(guild.ID, user.ID)
+		}
+	}
+
+	play := func(priority Priority) {
+		err := enqueuePlay(user, guild, coll, sound, allowed, priority, target)
+		if err != nil {
+			countDroppedPlay(err)
+			refund()
+		}
+
+		if err == errVoiceChannelBlocked && ctx.Settings.BlockedMessage != "" {
+			ctx.Reply(ctx.Settings.BlockedMessage)
+		} else if err != nil {
+			ctx.Feedback(err.Error())
+		}
+	}
+
+	// Only owners can override quiet hours
+	if until, quiet := ctx.Settings.QuietUntil(time.Now()); quiet && ctx.Level < LevelOwner {
+		switch {
+		case ctx.Settings.QuietMode == QUIET_QUEUE:
+			// Deferred plays go ahead of anyone asking once quiet hours end
+			deferred := func() {
+				if priority > PriorityScheduled {
+					play(PriorityScheduled)
+				} else {
+					play(priority)
+				}
+			}
+
+			if !deferPlay(guild.ID, user.ID, until, ctx.Settings.QueueSize, deferred) {
+				countDroppedPlay(errQueueFull)
+				refund()
+				ctx.Feedback(errQueueFull.Error())
+				return
+			}
+			ctx.Feedback(fmt.Sprintf("It's quiet hours, your sound will play at %s", until.Format("15:04 MST")))
+			return
+		case ctx.Settings.QuietMode == QUIET_ROLE && hasAnyRole(ctx.Roles, ctx.Settings.QuietRoles):
+		default:
+			playsDropped.WithLabelValues(DROP_QUIET_HOURS).Inc()
+			refund()
+			ctx.Feedback(fmt.Sprintf("It's quiet hours until %s", until.Format("15:04 MST")))
+			return
+		}
+	}
+
+	// We may have started shutting down since the message came in
+	if !trackPlay(func() { play(priority) }) {
+		playsDropped.WithLabelValues(DROP_SHUTDOWN).Inc()
+		refund()
 	}
-	return
 }
 
-func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if len(m.Content) <= 0 || (m.Content[0] != '!' && len(m.Mentions) != 1) {
+func handleMessage(m *discordgo.Message) {
+	// Once we start shutting down, stop accepting commands
+	if isShuttingDown() {
+		return
+	}
+
+	if len(m.Content) == 0 || m.Author == nil {
 		return
 	}
 
-	parts := strings.Split(strings.ToLower(m.Content), " ")
+	// Blocked users are dropped before we do any work for them
+	if isBlocked(BLOCK_USER, m.Author.ID) {
+		return
+	}
 
-	channel, _ := discord.State.Channel(m.ChannelID)
+	channel, _ := client.Channel(m.ChannelID)
 	if channel == nil {
 		log.WithFields(log.Fields{
 			"channel": m.ChannelID,
@@ -575,7 +931,12 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	guild, _ := discord.State.Guild(channel.GuildID)
+	// Messages don't carry their guild, so this needs the channel
+	if isBlocked(BLOCK_GUILD, channel.GuildID) {
+		return
+	}
+
+	guild, _ := client.Guild(channel.GuildID)
 	if guild == nil {
 		log.WithFields(log.Fields{
 			"guild":   channel.GuildID,
@@ -585,70 +946,98 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	// If this is a mention, it should come from the owner (otherwise we don't care)
-	if len(m.Mentions) > 0 {
-		if m.Mentions[0].ID == s.State.Ready.User.ID && m.Author.ID == OWNER && len(parts) > 0 {
-			handleBotControlMessages(s, m, parts, guild)
-		}
-		return
-	}
-
 	// If it's not relevant to our shard, just exit
 	if !shardContains(guild.ID) {
 		return
 	}
 
-	// Find the collection for the command we got
-	for _, coll := range COLLECTIONS {
-		if scontains(parts[0], coll.Commands...) {
-
-			// If they passed a specific sound effect, find and select that (otherwise play nothing)
-			var sound *Sound
-			if len(parts) > 1 {
-				for _, s := range coll.Sounds {
-					if parts[1] == s.Name {
-						sound = s
-					}
-				}
-
-				if sound == nil {
-					return
-				}
-			}
-
-			go enqueuePlay(m.Author, guild, coll, sound)
-			return
-		}
+	settings := guildSettings(guild.ID)
+	invoked, name, args := parseCommand(m, settings.Prefixes)
+	if name == "" {
+		return
 	}
+
+	dispatchCommand(m, channel, guild, settings, invoked, name, args)
 }
 
 func main() {
 	var (
-		Token = flag.String("t", "", "Discord Authentication Token")
-		Redis = flag.String("r", "", "Redis Connection String")
-		Shard = flag.String("s", "", "Integers to shard by")
-		Owner = flag.String("o", "", "Owner ID")
-		err   error
+		Token           = flag.String("t", "", "Discord Authentication Token")
+		Redis           = flag.String("r", "", "Redis Connection String")
+		Shard           = flag.String("s", "", "Gateway shard as ID/COUNT or lease/COUNT, or legacy guild ID digits to shard by")
+		Owner           = flag.String("o", "", "Owner IDs, comma separated")
+		ShutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to let plays finish when shutting down")
+		Sink            = flag.String("sink", "discord", "Where to send plays: discord, ogg, wav or pipe")
+		SinkDir         = flag.String("sink-dir", "plays", "Directory the ogg and wav sinks write to")
+		SinkCmd         = flag.String("sink-cmd", DEFAULT_PIPE_COMMAND, "Audio player the pipe sink writes PCM to")
+		Supervise       = flag.String("supervise", "", "Run this many shard workers (or auto for the gateway's recommendation)")
+		Console         = flag.Bool("console", false, "Read commands from stdin instead of connecting to discord")
+		Forced          = flag.Bool("forced-first", false, "Play forced sounds before random sounds of the same priority")
+		RetainMinutes   = flag.Duration("retain-minutes", stats.Minute.TTL, "How long per-minute stats are kept (0 keeps them forever)")
+		RetainHours     = flag.Duration("retain-hours", stats.Hour.TTL, "How long hourly stats are kept (0 keeps them forever)")
+		RetainDays      = flag.Duration("retain-days", stats.Day.TTL, "How long daily stats are kept (0 keeps them forever)")
+		Stats           = flag.String("stats", "", "Stats store: redis, redis://<addr>, bolt://<path>, http://<addr> or memory (defaults to redis with -r)")
+		MigrateStats    = flag.String("migrate-stats", "", "Copy every stat into this store, then exit")
+		Metrics         = flag.String("metrics", "", "Address to serve prometheus metrics and pprof on, e.g. :9100")
+		PlayStream      = flag.String("play-stream", plays.STREAM, "Redis stream every play is published to (empty to turn off)")
+		PlayStreamLen   = flag.Int64("play-stream-max-len", 1000000, "Roughly how many plays the stream keeps (0 for no limit)")
+		PlayStreamAge   = flag.Duration("play-stream-max-age", 7*24*time.Hour, "Roughly how long the stream keeps plays (0 for no limit)")
+		err             error
 	)
 	flag.Parse()
 
 	if *Owner != "" {
-		OWNER = *Owner
+		OWNERS = strings.Split(*Owner, ",")
 	}
+	FORCED_FIRST = *Forced
+	stats.Minute.TTL, stats.Hour.TTL, stats.Day.TTL = *RetainMinutes, *RetainHours, *RetainDays
 
-	// Make sure shard is either empty, or an integer
-	if *Shard != "" {
-		SHARDS = strings.Split(*Shard, ",")
+	// As a supervisor we only run the shard workers, they do everything else
+	if *Supervise != "" {
+		count, err := superviseCount(*Supervise, *Token)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"supervise": *Supervise,
+				"error":     err,
+			}).Fatal("Invalid shard count")
+			return
+		}
 
-		for _, shard := range SHARDS {
-			if _, err := strconv.Atoi(shard); err != nil {
-				log.WithFields(log.Fields{
-					"shard": shard,
-					"error": err,
-				}).Fatal("Invalid Shard")
-				return
-			}
+		err = runSupervisor(count, *ShutdownTimeout)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Failed to run supervisor")
 		}
+		return
+	}
+
+	// Make sure shard is either empty, an ID/COUNT pair or a list of legacy digits
+	err = parseShardFlag(*Shard)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"shard": *Shard,
+			"error": err,
+		}).Fatal("Invalid Shard")
+		return
+	}
+
+	// Unless we're playing into discord, write plays to files or a local player
+	if *Sink == "pipe" {
+		newVoiceSink, err = pipeSinkFactory(*SinkCmd)
+	} else if *Sink != "discord" {
+		newVoiceSink, err = fileSinkFactory(*SinkDir, *Sink)
+	} else if *Console {
+		log.Fatal("Console mode requires the ogg, wav or pipe sink")
+		return
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sink":  *Sink,
+			"error": err,
+		}).Fatal("Invalid sink")
+		return
 	}
 
 	// Preload all the sounds
@@ -671,6 +1060,74 @@ func main() {
 		}
 	}
 
+	// Without a redis server, the console keeps stats in memory
+	statsSpec := *Stats
+	if *Console && rcli == nil && statsSpec == "" {
+		statsSpec = "memory"
+	}
+
+	err = openStatsStore(statsSpec)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"store": statsSpec,
+			"error": err,
+		}).Fatal("Failed to open the stats store")
+		return
+	}
+
+	if *MigrateStats != "" {
+		err = migrateStats(*MigrateStats)
+		statsStore.Close()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"target": *MigrateStats,
+				"error":  err,
+			}).Fatal("Failed to copy stats")
+		}
+		return
+	}
+
+	openPlayStream(*PlayStream, *PlayStreamLen, *PlayStreamAge)
+
+	// Wait for a signal to quit
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go sweepPlayRatesLoop()
+
+	// In console mode we never connect, commands come from stdin until it's closed
+	if *Console {
+		local := newConsoleClient(os.Stdout)
+		client = local
+		startMetrics(*Metrics)
+
+		done := make(chan struct{})
+		go func() {
+			runConsole(local, os.Stdin)
+			close(done)
+		}()
+
+		select {
+		case <-c:
+		case <-done:
+		}
+
+		gracefulShutdown(*ShutdownTimeout)
+		return
+	}
+
+	// Wait until we hold the lease on a shard
+	if SHARD_LEASE {
+		if rcli == nil {
+			log.Fatal("Shard leases require a redis connection")
+			return
+		}
+
+		if !claimShard(SHARD_COUNT, c) {
+			return
+		}
+	}
+
 	// Create a discord session
 	log.Info("Starting discord session...")
 	discord, err = discordgo.New(*Token)
@@ -680,11 +1137,54 @@ func main() {
 		}).Fatal("Failed to create discord session")
 		return
 	}
+	client = newDiscordClient(discord)
+	startMetrics(*Metrics)
+
+	// Refuse to start with a shard count the gateway doesn't expect
+	err = checkShardCount(discord)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"shard": shardDescription(),
+			"error": err,
+		}).Fatal("Invalid shard count")
+		return
+	}
+	discord.ShardID = SHARD_ID
+	discord.ShardCount = SHARD_COUNT
+
+	// Keep our lease and publish our health while we run
+	if rcli != nil && SHARD_COUNT > 0 {
+		go shardHeartbeatLoop()
+	}
+
+	// Answer owner commands handled by other shards and keep settings fresh
+	if rcli != nil {
+		err = loadBlocklist()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to load blocklist")
+		}
+
+		go controlLoop()
+		go settingsLoop()
+		go blocklistLoop()
+	}
 
 	discord.AddHandler(onReady)
+	discord.AddHandler(onConnect)
 	discord.AddHandler(onGuildCreate)
 	discord.AddHandler(onMessageCreate)
 
+	// If we're supervised, wait our turn to identify
+	err = waitForIdentify()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Failed to get identify slot from supervisor")
+		return
+	}
+
 	err = discord.Open()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -693,11 +1193,19 @@ func main() {
 		return
 	}
 
+	if supervisorAddr != "" {
+		go reportHealthLoop()
+	}
+
 	// We're running!
 	log.Info("AIRHORNBOT is ready to horn it up.")
 
-	// Wait for a signal to quit
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
+	select {
+	case <-c:
+		gracefulShutdown(*ShutdownTimeout)
+	case <-leaseLost:
+		// Another worker owns our shard now, get out of its way
+		gracefulShutdown(*ShutdownTimeout)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/hammerandchisel/airhornbot/stats"
+)
+
+var (
+	testBot   = &discordgo.User{ID: "300000000000000001", Username: "airhornbot", Bot: true}
+	testAdmin = &discordgo.User{ID: "300000000000000002", Username: "admin"}
+	testUser  = &discordgo.User{ID: "300000000000000003", Username: "user"}
+	testOwner = &discordgo.User{ID: "300000000000000004", Username: "owner"}
+)
+
+// testBotState is the fake the bot talks to in a test, and the sinks it
+// opened by guild ID
+type testBotState struct {
+	fake *fakeClient
+
+	sinks      map[string][]*fakeSink
+	sinksMutex sync.Mutex
+}
+
+// Points the bot at a fake client, fake voice sinks, an in-memory stats store
+// and empty settings, restoring everything once the test is done
+func setupTestBot(t *testing.T) *testBotState {
+	state := &testBotState{
+		fake:  newFakeClient(testBot),
+		sinks: make(map[string][]*fakeSink),
+	}
+
+	oldClient, oldStore, oldSink, oldOwners := client, statsStore, newVoiceSink, OWNERS
+	client = state.fake
+	statsStore = stats.NewMemoryStore()
+	OWNERS = []string{testOwner.ID}
+
+	// Sounds aren't loaded in tests, but random plays need their weights
+	for _, coll := range COLLECTIONS {
+		if coll.soundRange == 0 {
+			for _, sound := range coll.Sounds {
+				coll.soundRange += sound.Weight
+			}
+		}
+	}
+
+	// Each test starts with every guild on its default settings
+	settingsMutex.Lock()
+	oldCache, oldSettings := settingsCache, localSettings
+	settingsCache = make(map[string]*GuildSettings)
+	localSettings = make(map[string]map[string]string)
+	settingsMutex.Unlock()
+	newVoiceSink = func(guildID string) VoiceSink {
+		sink := &fakeSink{}
+		state.sinksMutex.Lock()
+		state.sinks[guildID] = append(state.sinks[guildID], sink)
+		state.sinksMutex.Unlock()
+		return sink
+	}
+
+	t.Cleanup(func() {
+		waitForPlays(t)
+		client, statsStore, newVoiceSink, OWNERS = oldClient, oldStore, oldSink, oldOwners
+
+		settingsMutex.Lock()
+		settingsCache, localSettings = oldCache, oldSettings
+		settingsMutex.Unlock()
+	})
+	return state
+}
+
+// Adds a guild owned by testAdmin with a text channel (id+1) and two voice
+// channels (id+2 and id+3), testAdmin and testUser start out in the first
+func (s *testBotState) addGuild(id string) *discordgo.Guild {
+	base, _ := strconv.ParseUint(id, 10, 64)
+	channelID := func(n uint64) string {
+		return strconv.FormatUint(base+n, 10)
+	}
+
+	everyone := discordgo.PermissionReadMessages | discordgo.PermissionSendMessages |
+		discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak
+
+	guild := &discordgo.Guild{
+		ID:      id,
+		Name:    "Test",
+		OwnerID: testAdmin.ID,
+		Channels: []*discordgo.Channel{
+			{ID: channelID(1), Name: "general", Type: "text"},
+			{ID: channelID(2), Name: "General", Type: "voice"},
+			{ID: channelID(3), Name: "Gaming", Type: "voice"},
+		},
+		Roles: []*discordgo.Role{
+			{ID: id, Name: "@everyone", Permissions: everyone},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: id, User: testBot},
+			{GuildID: id, User: testAdmin},
+			{GuildID: id, User: testUser},
+			{GuildID: id, User: testOwner},
+		},
+	}
+
+	s.fake.AddGuild(guild)
+	s.fake.SetVoiceChannel(id, testAdmin.ID, channelID(2))
+	s.fake.SetVoiceChannel(id, testUser.ID, channelID(2))
+	return guild
+}
+
+// Returns the sinks opened for a guild
+func (s *testBotState) guildSinks(guildID string) []*fakeSink {
+	s.sinksMutex.Lock()
+	defer s.sinksMutex.Unlock()
+	return append([]*fakeSink{}, s.sinks[guildID]...)
+}
+
+// Waits for every play and its stats to finish
+func waitForPlays(t *testing.T) {
+	if !waitTimeout(&playsWG, 10*time.Second) {
+		t.Fatal("Timed out waiting for plays")
+	}
+
+	if !waitTimeout(&statsWG, 10*time.Second) {
+		t.Fatal("Timed out waiting for stats")
+	}
+}
+
+func getStat(t *testing.T, key string) int64 {
+	n, err := statsStore.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPlayRouting(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("400000000000000000")
+	text, general, gaming := guild.Channels[0].ID, guild.Channels[1].ID, guild.Channels[2].ID
+
+	// Anything that isn't a command is ignored
+	state.fake.Send("1", testUser, text, "airhorn")
+	state.fake.Send("2", testUser, text, "!nothing")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("Non-commands opened %d voice sinks", len(sinks))
+	}
+
+	// A random sound in the user's channel
+	state.fake.Send("3", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	sinks := state.guildSinks(guild.ID)
+	if len(sinks) != 1 || len(sinks[0].joins) != 1 || sinks[0].joins[0] != general || sinks[0].sounds != 1 {
+		t.Fatalf("Random play went to %v, expected one sound in %s", sinks, general)
+	}
+
+	// A picked sound, mentioning the bot, in the channel the admin named
+	content := "<@" + testBot.ID + "> airhorn echo gaming"
+	state.fake.Send("4", testAdmin, text, content, testBot)
+	waitForPlays(t)
+
+	sinks = state.guildSinks(guild.ID)
+	if len(sinks) != 2 || len(sinks[1].joins) != 1 || sinks[1].joins[0] != gaming {
+		t.Fatalf("Forced play went to %v, expected %s", sinks, gaming)
+	}
+
+	// Admins get random sounds too
+	state.fake.Send("5", testAdmin, text, "!airhorn")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 3 || sinks[2].sounds != 1 {
+		t.Fatalf("Admin's random play went to %v, expected one sound", sinks)
+	}
+
+	// Users can't play into channels they aren't in
+	state.fake.Send("6", testUser, text, "!airhorn echo gaming")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 3 {
+		t.Fatalf("User played into a channel they aren't in")
+	}
+
+	// Messages from guilds we don't know about are dropped
+	state.fake.Send("7", testUser, "500000000000000001", "!airhorn")
+	waitForPlays(t)
+
+	if total := getStat(t, "airhorn:total"); total != 3 {
+		t.Errorf("Tracked %d plays, expected 3", total)
+	}
+}
+
+func TestPlayStats(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("410000000000000000")
+	text, general := guild.Channels[0].ID, guild.Channels[1].ID
+
+	state.fake.Send("1", testUser, text, "!airhorn")
+	waitForPlays(t)
+	state.fake.Send("2", testAdmin, text, "!airhorn echo")
+	waitForPlays(t)
+
+	expected := map[string]int64{
+		"airhorn:total":                                  2,
+		"airhorn:a:total":                                1,
+		"airhorn:a:priority:user":                        1,
+		"airhorn:f:total":                                1,
+		"airhorn:f:sound:echo":                           1,
+		"airhorn:f:priority:admin":                       1,
+		"airhorn:f:user:" + testAdmin.ID + ":sound:echo": 1,
+		"airhorn:f:guild:" + guild.ID + ":sound:echo":    1,
+		"airhorn:f:guild:" + guild.ID + ":chan:" + general + ":sound:echo": 1,
+	}
+
+	for key, count := range expected {
+		if n := getStat(t, key); n != count {
+			t.Errorf("%s is %d, expected %d", key, n, count)
+		}
+	}
+
+	for _, key := range []string{"airhorn:a:users", "airhorn:a:guilds", "airhorn:a:channels", "airhorn:f:users"} {
+		if n, _ := statsStore.SCard(key); n != 1 {
+			t.Errorf("%s has %d members, expected 1", key, n)
+		}
+	}
+
+	user, err := stats.LoadUser(statsStore, testAdmin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Forced != 1 || user.Random != 0 || len(user.Sounds) != 1 || user.Sounds[0].ID != "airhorn/echo" {
+		t.Errorf("Admin's stats are %+v, expected one forced play of airhorn/echo", user)
+	}
+}
+
+func TestPlayTargeting(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("420000000000000000")
+	text, general, gaming := guild.Channels[0].ID, guild.Channels[1].ID, guild.Channels[2].ID
+
+	dj := &discordgo.Role{ID: "420000000000000009", Name: "DJ"}
+	guild.Roles = append(guild.Roles, dj)
+	guild.Members[2].Roles = []string{dj.ID}
+
+	// Naming the channel they're in needs no permission
+	state.fake.Send("1", testUser, text, "!airhorn echo general")
+	waitForPlays(t)
+
+	sinks := state.guildSinks(guild.ID)
+	if len(sinks) != 1 || len(sinks[0].joins) != 1 || sinks[0].joins[0] != general {
+		t.Fatalf("Play into the user's own channel went to %v, expected %s", sinks, general)
+	}
+
+	// Other channels need a target role
+	state.fake.Send("2", testUser, text, "!airhorn echo gaming")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Fatalf("User played into a channel they aren't in without a target role")
+	}
+
+	defer invalidateSettings(guild.ID)
+	if err := storeSetting(guild.ID, "target_roles", dj.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	state.fake.Send("3", testUser, text, "!airhorn echo gaming")
+	waitForPlays(t)
+
+	sinks = state.guildSinks(guild.ID)
+	if len(sinks) != 2 || len(sinks[1].joins) != 1 || sinks[1].joins[0] != gaming {
+		t.Fatalf("Target role play went to %v, expected %s", sinks, gaming)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errVoiceChannelBlocked = errors.New("Sounds can't be played in that channel")
+
+// Whether commands are accepted in a text channel
+func (s *GuildSettings) TextChannelAllowed(channelID string) bool {
+	return channelAllowed(channelID, s.TextChannels, s.BlockedTextChannels)
+}
+
+// Whether sounds may be played in a voice channel
+func (s *GuildSettings) VoiceChannelAllowed(channelID string) bool {
+	return channelAllowed(channelID, s.VoiceChannels, s.BlockedVoiceChannels)
+}
+
+// A channel is allowed if it's in the allowlist, or the allowlist is empty,
+// and it isn't in the blocklist
+func channelAllowed(channelID string, allowed, blocked []string) bool {
+	if len(allowed) != 0 && !scontains(channelID, allowed...) {
+		return false
+	}
+	return !scontains(channelID, blocked...)
+}
+
+// Builds a setting holding a list of text or voice channel IDs, empty is
+// the value used to clear the list
+func channelListSetting(name, help string, voice bool, empty string, field func(s *GuildSettings) *[]string) *setting {
+	kind, usage := "text", "<#channel...>|"+empty
+	if voice {
+		kind, usage = "voice", "<channel, ...>|"+empty
+	}
+
+	return &setting{
+		Name:  name,
+		Usage: usage,
+		Help:  help,
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			// Voice channel names can have spaces, so they're separated by commas
+			var items []string
+			if voice {
+				items = make([]string, 0)
+				for _, item := range strings.Split(strings.Join(args, " "), ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						items = append(items, item)
+					}
+				}
+			} else {
+				items = splitArgs(args)
+			}
+
+			if len(items) == 1 && items[0] == empty {
+				return "", nil
+			}
+
+			ids := make([]string, 0, len(items))
+			for _, item := range items {
+				var channel *discordgo.Channel
+				if voice {
+					channel = findVoiceChannel(item, guild)
+				} else {
+					channel = findTextChannel(item, guild)
+				}
+
+				if channel == nil {
+					return "", fmt.Errorf("there's no %s channel `%s`", kind, item)
+				}
+
+				if !scontains(channel.ID, ids...) {
+					ids = append(ids, channel.ID)
+				}
+			}
+			return strings.Join(ids, ","), nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			*field(s) = splitList(value)
+		},
+		format: func(s *GuildSettings) string {
+			ids := *field(s)
+			if len(ids) == 0 {
+				return empty
+			}
+			return "<#" + strings.Join(ids, ">, <#") + ">"
+		},
+	}
+}
+
+// Attempts to find a text channel inside a given guild from a channel mention or name
+func findTextChannel(ref string, guild *discordgo.Guild) *discordgo.Channel {
+	for _, channel := range guild.Channels {
+		if channel.Type != "text" {
+			continue
+		}
+
+		if ref == "<#"+channel.ID+">" || strings.TrimPrefix(ref, "#") == strings.ToLower(channel.Name) {
+			return channel
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChannelAllowed(t *testing.T) {
+	cases := []struct {
+		channel string
+		allowed []string
+		blocked []string
+		result  bool
+	}{
+		{"1", nil, nil, true},
+		{"1", []string{"1", "2"}, nil, true},
+		{"3", []string{"1", "2"}, nil, false},
+		{"1", nil, []string{"1"}, false},
+		{"2", nil, []string{"1"}, true},
+		{"1", []string{"1"}, []string{"1"}, false},
+	}
+
+	for _, c := range cases {
+		if result := channelAllowed(c.channel, c.allowed, c.blocked); result != c.result {
+			t.Errorf("%s with allowed %v and blocked %v is %v, expected %v",
+				c.channel, c.allowed, c.blocked, result, c.result)
+		}
+	}
+}
+
+func TestChannelSettings(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("550000000000000000")
+	text, general, gaming := guild.Channels[0].ID, guild.Channels[1].ID, guild.Channels[2].ID
+
+	cases := []struct {
+		setting string
+		value   string
+		stored  string
+		valid   bool
+	}{
+		{"channels", "#general", text, true},
+		{"channels", "<#" + text + ">", text, true},
+		{"channels", "all", "", true},
+		{"channels", "gaming", "", false},
+		{"voice_channels", "general, gaming", general + "," + gaming, true},
+		{"blocked_voice_channels", "gaming", gaming, true},
+		{"blocked_voice_channels", "lobby", "", false},
+	}
+
+	for _, c := range cases {
+		value, err := findSetting(c.setting).parse(guild, strings.Fields(c.value))
+		if (err == nil) != c.valid {
+			t.Errorf("%s %q: got error %v, expected valid %v", c.setting, c.value, err, c.valid)
+			continue
+		}
+
+		if c.valid && value != c.stored {
+			t.Errorf("%s %q stored as %q, expected %q", c.setting, c.value, value, c.stored)
+		}
+	}
+}
+
+func TestBlockedVoiceChannel(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("560000000000000000")
+	text, general := guild.Channels[0].ID, guild.Channels[1].ID
+
+	if err := storeSetting(guild.ID, "blocked_voice_channels", general); err != nil {
+		t.Fatal(err)
+	}
+
+	state.fake.Send("1", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("Played in a blocked voice channel")
+	}
+
+	// Admins can still play into the channels that aren't blocked
+	state.fake.Send("2", testAdmin, text, "!airhorn echo gaming")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Fatalf("Played %d times into an allowed channel, expected 1", len(sinks))
+	}
+}
+
+func TestBlockedTextChannel(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("570000000000000000")
+	text := guild.Channels[0].ID
+
+	for name, value := range map[string]string{
+		"blocked_channels": text,
+		"blocked_message":  "Not in here",
+	} {
+		if err := storeSetting(guild.ID, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state.fake.Send("1", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 0 {
+		t.Fatalf("Played a command from a blocked text channel")
+	}
+
+	messages := state.fake.Messages()
+	if len(messages) != 1 || messages[0].Content != "Not in here" {
+		t.Errorf("Blocked command replied %v, expected the blocked message", messages)
+	}
+
+	// Admins can use any channel
+	state.fake.Send("2", testAdmin, text, "!airhorn echo")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Errorf("Admin's command in a blocked channel played %d times, expected 1", len(sinks))
+	}
+}
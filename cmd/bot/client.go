@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Client is the part of discord the bot's logic talks to, everything outside
+// of main and the discord voice sink goes through this instead of the session
+type Client interface {
+	// User returns the bot's own user
+	User() *discordgo.User
+
+	// Guilds returns every guild the bot is in
+	Guilds() []*discordgo.Guild
+
+	Guild(guildID string) (*discordgo.Guild, error)
+	Channel(channelID string) (*discordgo.Channel, error)
+	Member(guildID, userID string) (*discordgo.Member, error)
+	UserChannelPermissions(userID, channelID string) (int, error)
+
+	SendMessage(channelID, content string) error
+	SendEmbed(channelID string, embed *discordgo.MessageEmbed) error
+	LeaveGuild(guildID string) error
+	UpdateStatus(status string) error
+	Close() error
+}
+
+// discordClient is a Client backed by a discordgo session and its state
+type discordClient struct {
+	s *discordgo.Session
+}
+
+func newDiscordClient(s *discordgo.Session) Client {
+	return &discordClient{s: s}
+}
+
+func (d *discordClient) User() *discordgo.User {
+	return d.s.State.Ready.User
+}
+
+func (d *discordClient) Guilds() []*discordgo.Guild {
+	return d.s.State.Ready.Guilds
+}
+
+func (d *discordClient) Guild(guildID string) (*discordgo.Guild, error) {
+	return d.s.State.Guild(guildID)
+}
+
+func (d *discordClient) Channel(channelID string) (*discordgo.Channel, error) {
+	return d.s.State.Channel(channelID)
+}
+
+func (d *discordClient) Member(guildID, userID string) (*discordgo.Member, error) {
+	return d.s.State.Member(guildID, userID)
+}
+
+func (d *discordClient) UserChannelPermissions(userID, channelID string) (int, error) {
+	return d.s.State.UserChannelPermissions(userID, channelID)
+}
+
+func (d *discordClient) SendMessage(channelID, content string) error {
+	_, err := d.s.ChannelMessageSend(channelID, content)
+	return err
+}
+
+func (d *discordClient) SendEmbed(channelID string, embed *discordgo.MessageEmbed) error {
+	_, err := d.s.ChannelMessageSendEmbed(channelID, embed)
+	return err
+}
+
+func (d *discordClient) LeaveGuild(guildID string) error {
+	return d.s.GuildLeave(guildID)
+}
+
+func (d *discordClient) UpdateStatus(status string) error {
+	return d.s.UpdateStatus(0, status)
+}
+
+func (d *discordClient) Close() error {
+	return d.s.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeMessage is a message sent through a fakeClient
+type fakeMessage struct {
+	ChannelID string
+	Content   string
+}
+
+// fakeClient is a local client that records what the bot sends, and doubles
+// as a fake gateway dispatching events to the bot's handlers
+type fakeClient struct {
+	*localClient
+
+	messages      []fakeMessage
+	messagesMutex sync.Mutex
+}
+
+func newFakeClient(user *discordgo.User) *fakeClient {
+	return &fakeClient{localClient: newLocalClient(user, nil)}
+}
+
+func (f *fakeClient) SendMessage(channelID, content string) error {
+	f.messagesMutex.Lock()
+	defer f.messagesMutex.Unlock()
+
+	f.messages = append(f.messages, fakeMessage{ChannelID: channelID, Content: content})
+	return nil
+}
+
+func (f *fakeClient) SendEmbed(channelID string, embed *discordgo.MessageEmbed) error {
+	return f.SendMessage(channelID, formatEmbed(embed))
+}
+
+// Messages returns every message sent so far
+func (f *fakeClient) Messages() []fakeMessage {
+	f.messagesMutex.Lock()
+	defer f.messagesMutex.Unlock()
+	return append([]fakeMessage{}, f.messages...)
+}
+
+// CreateGuild adds a guild and dispatches a GUILD_CREATE for it
+func (f *fakeClient) CreateGuild(guild *discordgo.Guild) {
+	f.AddGuild(guild)
+	handleGuildCreate(guild)
+}
+
+// Send dispatches a MESSAGE_CREATE from author, mentioning the given users
+func (f *fakeClient) Send(id string, author *discordgo.User, channelID, content string, mentions ...*discordgo.User) {
+	handleMessage(&discordgo.Message{
+		ID:        id,
+		ChannelID: channelID,
+		Content:   content,
+		Author:    author,
+		Mentions:  mentions,
+	})
+}
+
+// fakeSink is a voice sink recording the channels it joined and the sounds
+// sent to it
+type fakeSink struct {
+	sync.Mutex
+
+	channelID string
+	joins     []string
+	sounds    int
+}
+
+func (s *fakeSink) Join(channelID string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.channelID = channelID
+	s.joins = append(s.joins, channelID)
+	return nil
+}
+
+func (s *fakeSink) ChannelID() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.channelID
+}
+
+func (s *fakeSink) Speaking(speaking bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if speaking {
+		s.sounds++
+	}
+	return nil
+}
+
+func (s *fakeSink) Send(opus []byte) error {
+	return nil
+}
+
+func (s *fakeSink) Disconnect() error {
+	s.Lock()
+	defer s.Unlock()
+	s.channelID = ""
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	errUnknownChannel = errors.New("unknown channel")
+	errUnknownGuild   = errors.New("unknown guild")
+	errUnknownMember  = errors.New("unknown member")
+)
+
+// Permissions granted to guild owners and administrators
+const allPermissions = 1<<31 - 1
+
+// localClient is an in-memory Client holding its own guilds, channels and
+// voice states, used by console mode in place of a discord session
+type localClient struct {
+	sync.RWMutex
+
+	user     *discordgo.User
+	guilds   []*discordgo.Guild
+	channels map[string]*discordgo.Channel
+	status   string
+
+	// If set, sent messages are written here
+	out io.Writer
+}
+
+func newLocalClient(user *discordgo.User, out io.Writer) *localClient {
+	return &localClient{
+		user:     user,
+		channels: make(map[string]*discordgo.Channel),
+		out:      out,
+	}
+}
+
+func (c *localClient) User() *discordgo.User {
+	return c.user
+}
+
+func (c *localClient) Guilds() []*discordgo.Guild {
+	c.RLock()
+	defer c.RUnlock()
+	return append([]*discordgo.Guild{}, c.guilds...)
+}
+
+func (c *localClient) Guild(guildID string) (*discordgo.Guild, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.guild(guildID)
+}
+
+func (c *localClient) guild(guildID string) (*discordgo.Guild, error) {
+	for _, guild := range c.guilds {
+		if guild.ID == guildID {
+			return guild, nil
+		}
+	}
+	return nil, errUnknownGuild
+}
+
+func (c *localClient) Channel(channelID string) (*discordgo.Channel, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	channel, ok := c.channels[channelID]
+	if !ok {
+		return nil, errUnknownChannel
+	}
+	return channel, nil
+}
+
+func (c *localClient) Member(guildID, userID string) (*discordgo.Member, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	guild, err := c.guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range guild.Members {
+		if member.User.ID == userID {
+			return member, nil
+		}
+	}
+	return nil, errUnknownMember
+}
+
+// UserChannelPermissions combines the @everyone role with the member's roles,
+// channel permission overwrites are not modelled
+func (c *localClient) UserChannelPermissions(userID, channelID string) (int, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	channel, ok := c.channels[channelID]
+	if !ok {
+		return 0, errUnknownChannel
+	}
+
+	guild, err := c.guild(channel.GuildID)
+	if err != nil {
+		return 0, err
+	}
+
+	if guild.OwnerID == userID {
+		return allPermissions, nil
+	}
+
+	var member *discordgo.Member
+	for _, m := range guild.Members {
+		if m.User.ID == userID {
+			member = m
+			break
+		}
+	}
+
+	if member == nil {
+		return 0, errUnknownMember
+	}
+
+	perms := 0
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID || scontains(role.ID, member.Roles...) {
+			perms |= role.Permissions
+		}
+	}
+
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return allPermissions, nil
+	}
+	return perms, nil
+}
+
+func (c *localClient) SendMessage(channelID, content string) error {
+	if c.out != nil {
+		fmt.Fprintln(c.out, content)
+	}
+	return nil
+}
+
+func (c *localClient) SendEmbed(channelID string, embed *discordgo.MessageEmbed) error {
+	return c.SendMessage(channelID, formatEmbed(embed))
+}
+
+// Formats an embed as plain text, with the title and field names in bold
+func formatEmbed(embed *discordgo.MessageEmbed) string {
+	lines := make([]string, 0)
+	if embed.Title != "" {
+		lines = append(lines, "**"+embed.Title+"**")
+	}
+
+	if embed.Description != "" {
+		lines = append(lines, embed.Description)
+	}
+
+	for _, field := range embed.Fields {
+		lines = append(lines, "**"+field.Name+"**", field.Value)
+	}
+
+	if embed.Footer != nil && embed.Footer.Text != "" {
+		lines = append(lines, embed.Footer.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *localClient) LeaveGuild(guildID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, guild := range c.guilds {
+		if guild.ID != guildID {
+			continue
+		}
+
+		for _, channel := range guild.Channels {
+			delete(c.channels, channel.ID)
+		}
+		c.guilds = append(c.guilds[:i], c.guilds[i+1:]...)
+		return nil
+	}
+	return errUnknownGuild
+}
+
+func (c *localClient) UpdateStatus(status string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.status = status
+	return nil
+}
+
+func (c *localClient) Close() error {
+	return nil
+}
+
+// AddGuild adds a guild and its channels to the client
+func (c *localClient) AddGuild(guild *discordgo.Guild) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.guilds = append(c.guilds, guild)
+	for _, channel := range guild.Channels {
+		channel.GuildID = guild.ID
+		c.channels[channel.ID] = channel
+	}
+}
+
+// SetVoiceChannel moves a user into a voice channel, or out of voice if channelID is empty
+func (c *localClient) SetVoiceChannel(guildID, userID, channelID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	guild, err := c.guild(guildID)
+	if err != nil {
+		return err
+	}
+
+	states := make([]*discordgo.VoiceState, 0, len(guild.VoiceStates)+1)
+	for _, vs := range guild.VoiceStates {
+		if vs.UserID != userID {
+			states = append(states, vs)
+		}
+	}
+
+	if channelID != "" {
+		states = append(states, &discordgo.VoiceState{
+			GuildID:   guildID,
+			UserID:    userID,
+			ChannelID: channelID,
+		})
+	}
+
+	guild.VoiceStates = states
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Level is the permission level required to run a command
+type Level int
+
+const (
+	LevelUser Level = iota
+	LevelAdmin
+	LevelOwner
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelAdmin:
+		return "admin"
+	case LevelOwner:
+		return "owner"
+	}
+	return "user"
+}
+
+// Command is a bot command, run either as the guild's prefix followed by the
+// name or by mentioning the bot followed by the name
+type Command struct {
+	Name    string
+	Aliases []string
+
+	// Describes the arguments for help output, e.g. "[sound] [channel]"
+	Usage string
+
+	// Bounds on the number of arguments, MaxArgs < 0 means no limit
+	MinArgs int
+	MaxArgs int
+
+	Help  string
+	Level Level
+
+	// Commands run by giving their name as the first argument, e.g. config
+	// in !airhorn config
+	Subcommands []*Command
+
+	// If nil, the command only groups its subcommands
+	Run func(ctx *CommandContext)
+}
+
+// CommandContext is everything a command needs to handle one invocation
+type CommandContext struct {
+	Message *discordgo.Message
+	Guild   *discordgo.Guild
+	Channel *discordgo.Channel
+	Command *Command
+	Args    []string
+	Level   Level
+
+	// IDs of the author's roles in the guild
+	Roles []string
+
+	Settings *GuildSettings
+
+	// The name the command was invoked with, including its prefix and the
+	// names of any subcommands
+	Invoked string
+}
+
+func (ctx *CommandContext) Reply(content string) {
+	client.SendMessage(ctx.Channel.ID, content)
+}
+
+func (ctx *CommandContext) ReplyEmbed(embed *discordgo.MessageEmbed) {
+	client.SendEmbed(ctx.Channel.ID, embed)
+}
+
+// Returns ctx.Args as they were typed, for arguments that are free text
+func (ctx *CommandContext) RawArgs() []string {
+	fields := strings.Fields(ctx.Message.Content)
+
+	raw := make([]string, len(ctx.Args))
+	for i, arg := range ctx.Args {
+		// Arguments an alias added have no original
+		j := len(fields) - len(ctx.Args) + i
+		if j >= 0 && strings.ToLower(fields[j]) == arg {
+			raw[i] = fields[j]
+		} else {
+			raw[i] = arg
+		}
+	}
+	return raw
+}
+
+// Explains why a command did nothing, if the guild wants to be told
+func (ctx *CommandContext) Feedback(content string) {
+	if ctx.Settings.Feedback == FEEDBACK_TEXT {
+		ctx.Reply(content)
+	}
+}
+
+func (cmd *Command) subcommand(name string) *Command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name || scontains(name, sub.Aliases...) {
+			return sub
+		}
+	}
+	return nil
+}
+
+var (
+	// Every registered command, in the order they are shown in help
+	COMMANDS []*Command
+
+	// Registered commands by name and alias
+	commandsByName = make(map[string]*Command)
+
+	// Bot owner IDs, these can run every command in every guild
+	OWNERS []string
+)
+
+func registerCommand(cmd *Command) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, exists := commandsByName[name]; exists {
+			log.WithFields(log.Fields{
+				"command": name,
+			}).Fatal("Command registered twice")
+		}
+		commandsByName[name] = cmd
+	}
+	COMMANDS = append(COMMANDS, cmd)
+}
+
+func init() {
+	for _, coll := range COLLECTIONS {
+		registerCollectionCommand(coll)
+	}
+
+	airhorn := commandsByName["airhorn"]
+	airhorn.Subcommands = append(airhorn.Subcommands, configCommand, aliasCommand, roleCommand, optoutCommand, topCommand, meCommand, userStatsCommand)
+
+	registerCommand(&Command{
+		Name:    "help",
+		MaxArgs: 1,
+		Usage:   "[command]",
+		Help:    "Lists the commands you can use, or explains one",
+		Level:   LevelUser,
+		Run:     runHelp,
+	})
+
+	registerCommand(&Command{
+		Name:  "queue",
+		Help:  "Shows queued plays on this shard and in this server",
+		Level: LevelOwner,
+		Run: func(ctx *CommandContext) {
+			displayQueues(ctx.Channel.ID, ctx.Guild)
+		},
+	})
+
+	registerCommand(&Command{
+		Name:  "stats",
+		Help:  "Shows versions, memory and per-shard numbers",
+		Level: LevelOwner,
+		Run: func(ctx *CommandContext) {
+			displayBotStats(ctx.Channel.ID)
+		},
+	})
+
+	registerCommand(&Command{
+		Name:  "status",
+		Help:  "Shows the state of every shard",
+		Level: LevelOwner,
+		Run: func(ctx *CommandContext) {
+			displayShardStatus(ctx.Channel.ID)
+		},
+	})
+
+	registerCommand(&Command{
+		Name:  "aps",
+		Help:  "Shows the rolling and peak airhorns per second of the last day",
+		Level: LevelOwner,
+		Run: func(ctx *CommandContext) {
+			displayAirhornsPerSecond(ctx.Channel.ID)
+		},
+	})
+}
+
+// Registers the command playing a sound collection, its first command is
+// the name and the rest are aliases
+func registerCollectionCommand(coll *SoundCollection) {
+	names := make([]string, 0, len(coll.Commands))
+	for _, name := range coll.Commands {
+		names = append(names, strings.TrimPrefix(name, "!"))
+	}
+
+	registerCommand(&Command{
+		Name:    names[0],
+		Aliases: names[1:],
+		Usage:   "[sound] [channel]",
+		MaxArgs: -1,
+		Help:    fmt.Sprintf("Plays a random %s sound, or the one named, in your voice channel or the one named", coll.Prefix),
+		Level:   LevelUser,
+		Run: func(ctx *CommandContext) {
+			playCollection(ctx, coll)
+		},
+	})
+}
+
+// Whether a user is one of the bot owners
+func isOwner(userID string) bool {
+	return scontains(userID, OWNERS...)
+}
+
+// Returns a user's permission level in a channel, guild admins are users with
+// the Manage Server permission
+func userLevel(user *discordgo.User, channelID string) Level {
+	if isOwner(user.ID) {
+		return LevelOwner
+	}
+
+	perms, err := client.UserChannelPermissions(user.ID, channelID)
+	if err == nil && perms&discordgo.PermissionManageServer != 0 {
+		return LevelAdmin
+	}
+	return LevelUser
+}
+
+// Splits a message into the command name it invokes and its arguments. The
+// name is empty if the message is not a command, either because it doesn't
+// start with one of the prefixes or it doesn't start by mentioning us.
+func parseCommand(m *discordgo.Message, prefixes []string) (invoked, name string, args []string) {
+	fields := strings.Fields(strings.ToLower(m.Content))
+	if len(fields) == 0 {
+		return "", "", nil
+	}
+
+	// The longest prefix wins, so ! and !! can both be used
+	prefix := ""
+	for _, p := range prefixes {
+		if strings.HasPrefix(fields[0], p) && len(fields[0]) > len(p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+
+	if prefix != "" {
+		return fields[0], fields[0][len(prefix):], fields[1:]
+	}
+
+	me := client.User().ID
+	if len(m.Mentions) == 1 && m.Mentions[0].ID == me && len(fields) > 1 &&
+		(fields[0] == "<@"+me+">" || fields[0] == "<@!"+me+">") {
+		return fields[0] + " " + fields[1], fields[1], fields[2:]
+	}
+	return "", "", nil
+}
+
+// Looks up and runs the command a message invokes, if the author may run it
+func dispatchCommand(m *discordgo.Message, channel *discordgo.Channel, guild *discordgo.Guild, settings *GuildSettings, invoked, name string, args []string) {
+	if settings.IsDisabled(name) {
+		return
+	}
+
+	// Guild aliases run the command line they map to, followed by any arguments
+	if line, exists := settings.Aliases[name]; exists {
+		fields := strings.Fields(line)
+		name = fields[0]
+		args = append(fields[1:], args...)
+
+		// An alias can't get around a disabled command
+		if settings.IsDisabled(name) {
+			return
+		}
+	}
+
+	cmd, exists := commandsByName[name]
+	if !exists {
+		return
+	}
+
+	for len(args) > 0 {
+		sub := cmd.subcommand(args[0])
+		if sub == nil {
+			break
+		}
+
+		cmd = sub
+		invoked += " " + args[0]
+		args = args[1:]
+	}
+
+	level := userLevel(m.Author, channel.ID)
+	roles := memberRoles(guild.ID, m.Author.ID)
+
+	// Guilds can let roles run admin commands without Manage Server
+	if level < LevelAdmin && settings.CanManage(roles) {
+		level = LevelAdmin
+	}
+
+	// Admins can use any channel and don't need a role, so they can't lock
+	// themselves out
+	if level < LevelAdmin && (!settings.TextChannelAllowed(channel.ID) || !settings.HasRequiredRole(roles)) {
+		if settings.BlockedMessage != "" {
+			client.SendMessage(channel.ID, settings.BlockedMessage)
+		}
+		return
+	}
+
+	if level < cmd.Level {
+		// Owner commands stay hidden from everyone else
+		if cmd.Level == LevelAdmin {
+			client.SendMessage(channel.ID, fmt.Sprintf("`%s` needs the Manage Server permission", invoked))
+		}
+		return
+	}
+
+	if cmd.Run == nil || len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		client.SendMessage(channel.ID, fmt.Sprintf("Usage: `%s`", commandUsage(invoked, cmd)))
+		return
+	}
+
+	cmd.Run(&CommandContext{
+		Message:  m,
+		Guild:    guild,
+		Channel:  channel,
+		Command:  cmd,
+		Args:     args,
+		Level:    level,
+		Roles:    roles,
+		Settings: settings,
+		Invoked:  invoked,
+	})
+}
+
+func commandUsage(invoked string, cmd *Command) string {
+	if cmd.Usage == "" {
+		return invoked
+	}
+	return invoked + " " + cmd.Usage
+}
+
+// Writes a help line for each subcommand of cmd the level may run, recursively
+func writeSubcommandHelp(w io.Writer, invoked string, cmd *Command, level Level) {
+	for _, sub := range cmd.Subcommands {
+		if level < sub.Level {
+			continue
+		}
+
+		name := invoked + " " + sub.Name
+		if sub.Run != nil {
+			fmt.Fprintf(w, "%s\t%s\n", commandUsage(name, sub), sub.Help)
+		}
+		writeSubcommandHelp(w, name, sub, level)
+	}
+}
+
+func runHelp(ctx *CommandContext) {
+	prefix := ctx.Settings.Prefix()
+
+	if len(ctx.Args) == 1 {
+		name := ctx.Args[0]
+		for _, p := range ctx.Settings.Prefixes {
+			name = strings.TrimPrefix(name, p)
+		}
+
+		if line, exists := ctx.Settings.Aliases[name]; exists && !ctx.Settings.IsDisabled(name) {
+			ctx.Reply(fmt.Sprintf("`%s%s` is this server's alias for `%s%s`", prefix, name, prefix, line))
+			return
+		}
+
+		cmd, exists := commandsByName[name]
+		if !exists || ctx.Level < cmd.Level || ctx.Settings.IsDisabled(name) {
+			ctx.Reply(fmt.Sprintf("No command named `%s`", ctx.Args[0]))
+			return
+		}
+
+		help := fmt.Sprintf("`%s` %s", commandUsage(prefix+cmd.Name, cmd), cmd.Help)
+
+		aliases := make([]string, 0, len(cmd.Aliases))
+		for _, alias := range cmd.Aliases {
+			if !ctx.Settings.IsDisabled(alias) {
+				aliases = append(aliases, prefix+alias)
+			}
+		}
+
+		if len(aliases) > 0 {
+			help += fmt.Sprintf(" (also `%s`)", strings.Join(aliases, "`, `"))
+		}
+
+		w := &tabwriter.Writer{}
+		buf := &bytes.Buffer{}
+
+		w.Init(buf, 0, 4, 1, ' ', 0)
+		writeSubcommandHelp(w, prefix+cmd.Name, cmd, ctx.Level)
+		w.Flush()
+
+		if buf.Len() > 0 {
+			help += "\n```\n" + buf.String() + "```"
+		}
+		ctx.Reply(help)
+		return
+	}
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	for _, cmd := range COMMANDS {
+		if ctx.Level < cmd.Level || ctx.Settings.IsDisabled(cmd.Name) {
+			continue
+		}
+
+		help := cmd.Help
+		if cmd.Level != LevelUser {
+			help = fmt.Sprintf("(%s) %s", cmd.Level, help)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", commandUsage(prefix+cmd.Name, cmd), help)
+	}
+
+	for _, name := range sortedAliases(ctx.Settings) {
+		if !ctx.Settings.IsDisabled(name) {
+			fmt.Fprintf(w, "%s%s\tRuns %s%s\n", prefix, name, prefix, ctx.Settings.Aliases[name])
+		}
+	}
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+
+	if quiet := ctx.Settings.QuietDescription(time.Now()); quiet != "" {
+		fmt.Fprintf(buf, "%s\n", quiet)
+	}
+	ctx.Reply(buf.String())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestOwnerCommands(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("470000000000000000")
+	text := guild.Channels[0].ID
+
+	// Guild admins aren't bot owners
+	for _, command := range []string{"!queue", "!stats", "!status", "!aps"} {
+		state.fake.Send("1", testUser, text, command)
+		state.fake.Send("2", testAdmin, text, command)
+	}
+
+	if messages := state.fake.Messages(); len(messages) != 0 {
+		t.Fatalf("Owner commands answered someone else: %v", messages)
+	}
+
+	state.fake.Send("3", testOwner, text, "!queue")
+	messages := state.fake.Messages()
+	if len(messages) != 1 || messages[0].ChannelID != text || !strings.Contains(messages[0].Content, "Active Queues") {
+		t.Fatalf("!queue sent %v, expected the queues", messages)
+	}
+}
+
+func TestUserLevel(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("480000000000000000")
+	text := guild.Channels[0].ID
+
+	cases := []struct {
+		user  *discordgo.User
+		level Level
+	}{
+		{testUser, LevelUser},
+		{testAdmin, LevelAdmin},
+		{testOwner, LevelOwner},
+	}
+
+	for _, c := range cases {
+		if level := userLevel(c.user, text); level != c.level {
+			t.Errorf("%s is a %s, expected %s", c.user.Username, level, c.level)
+		}
+	}
+}
+
+func TestHelpLevels(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("490000000000000000")
+	text := guild.Channels[0].ID
+
+	// Everyone only sees the commands they can run
+	cases := []struct {
+		user    *discordgo.User
+		command string
+		shown   []string
+		hidden  []string
+	}{
+		{testUser, "!help", []string{"!airhorn "}, []string{"!queue "}},
+		{testAdmin, "!help", []string{"!airhorn "}, []string{"!queue "}},
+		{testOwner, "!help", []string{"!airhorn ", "!queue "}, nil},
+		{testUser, "!help airhorn", []string{"!airhorn top "}, []string{"!airhorn config set "}},
+		{testAdmin, "!help airhorn", []string{"!airhorn top ", "!airhorn config set "}, nil},
+	}
+
+	for i, c := range cases {
+		state.fake.Send("1", c.user, text, c.command)
+		messages := state.fake.Messages()
+		if len(messages) != i+1 {
+			t.Fatalf("%s: %s sent %d messages, expected 1", c.user.Username, c.command, len(messages)-i)
+		}
+
+		help := messages[i].Content
+		for _, line := range c.shown {
+			if !strings.Contains(help, line) {
+				t.Errorf("%s: %s doesn't list %s", c.user.Username, c.command, line)
+			}
+		}
+
+		for _, line := range c.hidden {
+			if strings.Contains(help, line) {
+				t.Errorf("%s: %s lists %s", c.user.Username, c.command, line)
+			}
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	setupTestBot(t)
+
+	cases := []struct {
+		content  string
+		prefixes []string
+		name     string
+		args     string
+	}{
+		{"!airhorn echo", []string{"!"}, "airhorn", "echo"},
+		{"!!airhorn", []string{"!", "!!"}, "airhorn", ""},
+		{"!AIRHORN Gaming", []string{"!"}, "airhorn", "gaming"},
+		{"?airhorn", []string{"!"}, "", ""},
+		{"!", []string{"!"}, "", ""},
+		{"<@" + testBot.ID + "> airhorn echo", nil, "airhorn", "echo"},
+		{"<@!" + testBot.ID + "> airhorn", nil, "airhorn", ""},
+	}
+
+	for _, c := range cases {
+		m := &discordgo.Message{Content: c.content}
+		if strings.HasPrefix(c.content, "<@") {
+			m.Mentions = []*discordgo.User{testBot}
+		}
+
+		_, name, args := parseCommand(m, c.prefixes)
+		if name != c.name || strings.Join(args, " ") != c.args {
+			t.Errorf("%q parsed as %q %v, expected %q %q", c.content, name, args, c.name, c.args)
+		}
+	}
+}
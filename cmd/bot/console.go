@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// IDs used for the simulated guild in console mode
+const (
+	CONSOLE_GUILD_ID        = "100000000000000000"
+	CONSOLE_TEXT_CHANNEL_ID = "100000000000000001"
+	CONSOLE_USER_ID         = "100000000000000010"
+	CONSOLE_BOT_ID          = "100000000000000011"
+)
+
+var (
+	consoleUser = &discordgo.User{ID: CONSOLE_USER_ID, Username: "console"}
+	consoleBot  = &discordgo.User{ID: CONSOLE_BOT_ID, Username: "airhornbot", Bot: true}
+)
+
+// Builds a local client with a simulated guild holding a text channel and a few
+// voice channels, the console user owns the guild and starts out in the first
+// voice channel
+func newConsoleClient(out io.Writer) *localClient {
+	everyone := discordgo.PermissionReadMessages | discordgo.PermissionSendMessages |
+		discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak
+
+	guild := &discordgo.Guild{
+		ID:      CONSOLE_GUILD_ID,
+		Name:    "Console",
+		OwnerID: CONSOLE_USER_ID,
+		Channels: []*discordgo.Channel{
+			{ID: CONSOLE_TEXT_CHANNEL_ID, GuildID: CONSOLE_GUILD_ID, Name: "general", Type: "text"},
+		},
+		Roles: []*discordgo.Role{
+			{ID: CONSOLE_GUILD_ID, Name: "@everyone", Permissions: everyone},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: CONSOLE_GUILD_ID, User: consoleUser},
+			{GuildID: CONSOLE_GUILD_ID, User: consoleBot},
+		},
+	}
+
+	for i, name := range []string{"General", "Gaming", "AFK"} {
+		guild.Channels = append(guild.Channels, &discordgo.Channel{
+			ID:       strconv.Itoa(200000000000000000 + i),
+			GuildID:  CONSOLE_GUILD_ID,
+			Name:     name,
+			Type:     "voice",
+			Position: i,
+		})
+	}
+
+	local := newLocalClient(consoleBot, out)
+	local.AddGuild(guild)
+	local.SetVoiceChannel(CONSOLE_GUILD_ID, CONSOLE_USER_ID, guild.Channels[1].ID)
+	return local
+}
+
+// Moves the console user into a voice channel, or out of voice if name is empty
+func consoleJoin(local *localClient, name string) {
+	if name == "" {
+		local.SetVoiceChannel(CONSOLE_GUILD_ID, CONSOLE_USER_ID, "")
+		fmt.Fprintln(local.out, "Left voice")
+		return
+	}
+
+	guild, _ := local.Guild(CONSOLE_GUILD_ID)
+
+	channel := findVoiceChannel(strings.ToLower(name), guild)
+	if channel == nil {
+		fmt.Fprintf(local.out, "No voice channel named %q\n", name)
+		return
+	}
+
+	local.SetVoiceChannel(CONSOLE_GUILD_ID, CONSOLE_USER_ID, channel.ID)
+	fmt.Fprintf(local.out, "Joined %s\n", channel.Name)
+}
+
+// Reads commands from in and runs them as the console user in the simulated
+// guild. Lines starting with @ are sent as mentions of the bot, /join <channel>
+// and /leave move the console user between voice channels.
+func runConsole(local *localClient, in io.Reader) {
+	// The console user is the owner unless another one was given
+	if len(OWNERS) == 0 {
+		OWNERS = []string{CONSOLE_USER_ID}
+	}
+
+	fmt.Fprintln(local.out, "Console ready, type commands like `!airhorn echo` (ctrl-d to quit)")
+
+	scanner := bufio.NewScanner(in)
+	for id := 1; scanner.Scan(); id++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "/join "):
+			consoleJoin(local, strings.TrimSpace(line[len("/join "):]))
+			continue
+		case line == "/leave":
+			consoleJoin(local, "")
+			continue
+		}
+
+		m := &discordgo.Message{
+			ID:        strconv.Itoa(id),
+			ChannelID: CONSOLE_TEXT_CHANNEL_ID,
+			Content:   line,
+			Author:    consoleUser,
+		}
+
+		if strings.HasPrefix(line, "@") {
+			m.Content = fmt.Sprintf("<@%s> %s", CONSOLE_BOT_ID, strings.TrimSpace(line[1:]))
+			m.Mentions = []*discordgo.User{consoleBot}
+		}
+		handleMessage(m)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	// Redis channel every shard listens on for owner control requests
+	CONTROL_CHANNEL = "airhorn:control"
+
+	// How long to wait for the other shards to answer a control request
+	CONTROL_TIMEOUT = 3 * time.Second
+)
+
+var errControlTimeout = errors.New("timed out subscribing for control replies")
+
+// controlRequest asks every shard to publish its health to ReplyTo
+type controlRequest struct {
+	ID      string `json:"id"`
+	ReplyTo string `json:"reply_to"`
+}
+
+// Answers control requests from other shards until we shut down
+func controlLoop() {
+	pubsub, err := rcli.Subscribe(CONTROL_CHANNEL)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to subscribe to control channel")
+		return
+	}
+
+	go func() {
+		<-shutdown
+		pubsub.Close()
+	}()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to receive control request")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		req := controlRequest{}
+		err = json.Unmarshal([]byte(msg.Payload), &req)
+		if err != nil || req.ReplyTo == "" {
+			log.WithFields(log.Fields{
+				"payload": msg.Payload,
+				"error":   err,
+			}).Warning("Invalid control request")
+			continue
+		}
+
+		health := currentHealth()
+		health.ReportedAt = time.Now()
+		data, _ := json.Marshal(health)
+		rcli.Publish(req.ReplyTo, string(data))
+	}
+}
+
+// Asks every shard for its health and collects the replies until all shards
+// answered or the timeout passed. Without redis only our own health is returned.
+func gatherShardHealth() ([]*shardHealth, error) {
+	if rcli == nil {
+		return []*shardHealth{currentHealth()}, nil
+	}
+
+	req := controlRequest{ID: fmt.Sprintf("%s:%d", leaseOwner, time.Now().UnixNano())}
+	req.ReplyTo = CONTROL_CHANNEL + ":reply:" + req.ID
+
+	pubsub, err := rcli.Subscribe(req.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	defer pubsub.Close()
+
+	// Make sure we're subscribed before anyone can reply
+	deadline := time.Now().Add(CONTROL_TIMEOUT)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, errControlTimeout
+		}
+
+		msg, err := pubsub.ReceiveTimeout(remaining)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := msg.(*redis.Subscription); ok {
+			break
+		}
+	}
+
+	data, _ := json.Marshal(req)
+	err = rcli.Publish(CONTROL_CHANNEL, string(data)).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unsharded there's only ever one bot to hear from, with legacy digit
+	// shards we can't know how many there are so we wait for the deadline
+	expected := SHARD_COUNT
+	if expected == 0 && len(LEGACY_SHARDS) == 0 {
+		expected = 1
+	}
+
+	reports := make([]*shardHealth, 0)
+	for expected == 0 || len(reports) < expected {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			break
+		}
+
+		msg, err := pubsub.ReceiveTimeout(remaining)
+		if err != nil {
+			break
+		}
+
+		if msg, ok := msg.(*redis.Message); ok {
+			health := &shardHealth{}
+			if json.Unmarshal([]byte(msg.Payload), health) == nil {
+				reports = append(reports, health)
+			}
+		}
+	}
+
+	sort.Sort(byShard(reports))
+	return reports, nil
+}
+
+type byShard []*shardHealth
+
+func (s byShard) Len() int           { return len(s) }
+func (s byShard) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byShard) Less(i, j int) bool { return s[i].Shard < s[j].Shard }
+
+// Formats shard health reports as a table with a row per shard and a total
+func formatShardHealth(w *tabwriter.Writer, reports []*shardHealth) {
+	fmt.Fprintf(w, "Shard\tGuilds\tUsers\tVoice\tQueued\tMemory\tTasks\n")
+
+	total := shardHealth{Name: "Total"}
+	for _, health := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%d\n", health.Name, health.Guilds, health.Users,
+			health.Voice, health.Queued, humanize.Bytes(health.Memory), health.Goroutines)
+
+		total.Guilds += health.Guilds
+		total.Users += health.Users
+		total.Voice += health.Voice
+		total.Queued += health.Queued
+		total.Memory += health.Memory
+		total.Goroutines += health.Goroutines
+	}
+
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%d\n", total.Name, total.Guilds, total.Users,
+		total.Voice, total.Queued, humanize.Bytes(total.Memory), total.Goroutines)
+
+	if SHARD_COUNT > 0 && len(reports) < SHARD_COUNT {
+		fmt.Fprintf(w, "\nOnly %d of %d shards answered\n", len(reports), SHARD_COUNT)
+	}
+}
+
+// Gathers every shard's health, falling back to just ours if that fails
+func gatherShardHealthOrLocal() []*shardHealth {
+	reports, err := gatherShardHealth()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to gather shard health")
+		return []*shardHealth{currentHealth()}
+	}
+	return reports
+}
+
+func displayShardStatus(cid string) {
+	// Without redis, a supervisor can still tell us about every shard
+	if rcli == nil && supervisorAddr != "" {
+		workers, err := supervisorStatus()
+		if err == nil {
+			client.SendMessage(cid, formatSupervisorStatus(workers))
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to get status from supervisor")
+	}
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	formatShardHealth(w, gatherShardHealthOrLocal())
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	client.SendMessage(cid, buf.String())
+}
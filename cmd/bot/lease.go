@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// How long a shard lease lasts without a heartbeat
+	LEASE_TTL = 30 * time.Second
+
+	// How often lease holders heartbeat and standby workers look for a free shard
+	LEASE_INTERVAL = 10 * time.Second
+)
+
+// Renews the lease only if we still hold it
+const renewLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+// Releases the lease only if we still hold it
+const releaseLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+var (
+	// If true, our shard ID is claimed through a redis lease instead of being given
+	SHARD_LEASE bool
+
+	// Identifies this worker as a lease holder
+	leaseOwner = fmt.Sprintf("%s:%d", hostname(), os.Getpid())
+
+	// Closed if we lose our shard lease to another worker
+	leaseLost = make(chan struct{})
+
+	errLeaseLost = errors.New("shard lease lost")
+)
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+func shardLeaseKey(id, count int) string {
+	return fmt.Sprintf("airhorn:shard:%d:%d:lease", count, id)
+}
+
+func shardHealthKey(id, count int) string {
+	return fmt.Sprintf("airhorn:shard:%d:%d:health", count, id)
+}
+
+// Tries to take the lease on any free shard, returns -1 if they are all held
+func tryClaimShard(count int) (int, error) {
+	for id := 0; id < count; id++ {
+		ok, err := rcli.SetNX(shardLeaseKey(id, count), leaseOwner, LEASE_TTL).Result()
+		if err != nil {
+			return -1, err
+		}
+
+		if ok {
+			return id, nil
+		}
+	}
+	return -1, nil
+}
+
+// Blocks until we hold the lease on a shard, standing by while every shard is
+// taken. Returns false if we were asked to quit first.
+func claimShard(count int, quit <-chan os.Signal) bool {
+	for {
+		id, err := tryClaimShard(count)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to claim shard lease")
+		}
+
+		if id >= 0 {
+			SHARD_ID = id
+			log.WithFields(log.Fields{
+				"shard": shardDescription(),
+				"owner": leaseOwner,
+			}).Info("Claimed shard lease")
+			return true
+		}
+
+		log.WithFields(log.Fields{
+			"shards": count,
+		}).Info("Every shard is leased, standing by")
+
+		select {
+		case <-time.After(LEASE_INTERVAL):
+		case <-quit:
+			return false
+		}
+	}
+}
+
+func renewShardLease() error {
+	res, err := rcli.Eval(renewLeaseScript,
+		[]string{shardLeaseKey(SHARD_ID, SHARD_COUNT)},
+		[]string{leaseOwner, fmt.Sprint(int64(LEASE_TTL / time.Millisecond))}).Result()
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.(int64); n != 1 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// Gives up our shard lease so a standby worker can take over straight away
+func releaseShardLease() {
+	if !SHARD_LEASE || rcli == nil {
+		return
+	}
+
+	_, err := rcli.Eval(releaseLeaseScript,
+		[]string{shardLeaseKey(SHARD_ID, SHARD_COUNT)},
+		[]string{leaseOwner}).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to release shard lease")
+	}
+}
+
+// Publishes our shard's health to redis, it expires along with the lease if we stop
+func publishShardHealth() error {
+	health := currentHealth()
+	health.ReportedAt = time.Now()
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	return rcli.Set(shardHealthKey(SHARD_ID, SHARD_COUNT), string(data), LEASE_TTL).Err()
+}
+
+// Renews our lease (if we hold one) and publishes our health until we shut
+// down, closing leaseLost if another worker took our shard
+func shardHeartbeatLoop() {
+	for {
+		if SHARD_LEASE {
+			err := renewShardLease()
+			if err == errLeaseLost {
+				log.WithFields(log.Fields{
+					"shard": shardDescription(),
+				}).Error("Lost shard lease")
+				close(leaseLost)
+				return
+			}
+
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Failed to renew shard lease")
+			}
+		}
+
+		err := publishShardHealth()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to publish shard health")
+		}
+
+		select {
+		case <-time.After(LEASE_INTERVAL):
+		case <-shutdown:
+			return
+		}
+	}
+}
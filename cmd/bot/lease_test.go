@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLeaseFlag(t *testing.T) {
+	defer func(id, count int, lease bool) {
+		SHARD_ID, SHARD_COUNT, SHARD_LEASE = id, count, lease
+	}(SHARD_ID, SHARD_COUNT, SHARD_LEASE)
+
+	cases := []struct {
+		value string
+		count int
+		valid bool
+	}{
+		{"lease/8", 8, true},
+		{"lease/1", 1, true},
+		{"lease/0", 0, false},
+		{"lease/x", 0, false},
+		{"lease", 0, false},
+	}
+
+	for _, c := range cases {
+		SHARD_ID, SHARD_COUNT, SHARD_LEASE = 0, 0, false
+
+		err := parseShardFlag(c.value)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: got error %v, expected valid %v", c.value, err, c.valid)
+			continue
+		}
+
+		// The shard ID is only known once a lease is claimed
+		if c.valid && (!SHARD_LEASE || SHARD_COUNT != c.count || SHARD_ID != 0) {
+			t.Errorf("%q parsed as %d/%d (lease %v), expected a lease on one of %d",
+				c.value, SHARD_ID, SHARD_COUNT, SHARD_LEASE, c.count)
+		}
+	}
+}
+
+func TestShardLeaseKeys(t *testing.T) {
+	// Leases are per shard count, so workers started with a new count never
+	// wait on the old count's leases
+	keys := map[string]bool{}
+	for _, shard := range [][2]int{{0, 8}, {1, 8}, {0, 16}, {1, 16}} {
+		lease, health := shardLeaseKey(shard[0], shard[1]), shardHealthKey(shard[0], shard[1])
+		if keys[lease] || keys[health] || lease == health {
+			t.Errorf("Shard %d/%d shares a key: %s, %s", shard[0], shard[1], lease, health)
+		}
+		keys[lease], keys[health] = true, true
+	}
+
+	if key := shardLeaseKey(3, 16); key != "airhorn:shard:16:3:lease" {
+		t.Errorf("Lease key is %s", key)
+	}
+}
+
+func TestReleaseShardLeaseWithoutRedis(t *testing.T) {
+	defer func(lease bool) {
+		SHARD_LEASE = lease
+	}(SHARD_LEASE)
+
+	// Nothing to release without redis, and nothing to crash on either
+	SHARD_LEASE = true
+	releaseShardLease()
+}
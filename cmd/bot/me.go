@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	"github.com/hammerandchisel/airhornbot/stats"
+)
+
+var meCommand = &Command{
+	Name:  "me",
+	Help:  "Shows how much you've horned",
+	Level: LevelUser,
+	Run: func(ctx *CommandContext) {
+		displayUserStats(ctx, ctx.Message.Author)
+	},
+}
+
+var userStatsCommand = &Command{
+	Name:    "stats",
+	Usage:   "<@user>",
+	MinArgs: 1,
+	MaxArgs: 1,
+	Help:    "Shows how much someone has horned",
+	Level:   LevelUser,
+	Run: func(ctx *CommandContext) {
+		user := findMentionedUser(ctx, ctx.Args[0])
+		if user == nil {
+			ctx.Reply(fmt.Sprintf("There's no one called `%s` here", ctx.RawArgs()[0]))
+			return
+		}
+		displayUserStats(ctx, user)
+	},
+}
+
+// Finds a member of the guild from a mention or ID
+func findMentionedUser(ctx *CommandContext, ref string) *discordgo.User {
+	id := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(ref, "<@"), ">"), "!")
+	for _, user := range ctx.Message.Mentions {
+		if user.ID == id {
+			return user
+		}
+	}
+
+	member, err := client.Member(ctx.Guild.ID, id)
+	if err != nil || member == nil {
+		return nil
+	}
+	return member.User
+}
+
+// Finds a sound stored as <collection prefix>/<sound name> and its collection
+func findStoredSound(name string) (*SoundCollection, *Sound) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+
+	coll := findCollection(parts[0])
+	if coll == nil {
+		return nil, nil
+	}
+
+	for _, sound := range coll.Sounds {
+		if sound.Name == parts[1] {
+			return coll, sound
+		}
+	}
+	return nil, nil
+}
+
+func displayUserStats(ctx *CommandContext, user *discordgo.User) {
+	userStats, err := stats.LoadUser(statsStore, user.ID)
+	if err == nil && userStats.Total() == 0 {
+		ctx.Reply(fmt.Sprintf("%s hasn't horned anyone yet", user.Username))
+		return
+	}
+
+	var rank int64
+	if err == nil {
+		rank, _, err = stats.Rank(statsStore, stats.AllTime, stats.GuildUsersBoard(ctx.Guild.ID), user.ID)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  user.ID,
+			"error": err,
+		}).Warning("Failed to load user stats")
+		ctx.Reply("Failed to load those stats, try again in a bit")
+		return
+	}
+
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "Plays", Value: humanize.Comma(userStats.Total()), Inline: true},
+		{Name: "Picked", Value: humanize.Comma(userStats.Forced), Inline: true},
+		{Name: "Random", Value: humanize.Comma(userStats.Random), Inline: true},
+	}
+
+	if len(userStats.Sounds) > 0 {
+		favourite := userStats.Sounds[0]
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Favourite sound",
+			Value:  fmt.Sprintf("%s (%s plays)", formatRoleSound(favourite.ID), humanize.Comma(favourite.Count)),
+			Inline: true,
+		})
+	}
+
+	// The rarest sound is the least likely one they got at random
+	var rarest string
+	var rarestChance float64
+	for _, entry := range userStats.RandomSounds {
+		coll, sound := findStoredSound(entry.ID)
+		if sound == nil || sound.Weight == 0 {
+			continue
+		}
+
+		chance := float64(sound.Weight) / float64(coll.soundRange)
+		if rarest == "" || chance < rarestChance {
+			rarest, rarestChance = entry.ID, chance
+		}
+	}
+
+	if rarest != "" {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Rarest sound",
+			Value:  fmt.Sprintf("%s (1 in %.0f)", formatRoleSound(rarest), 1/rarestChance),
+			Inline: true,
+		})
+	}
+
+	if rank > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Rank in " + ctx.Guild.Name,
+			Value:  fmt.Sprintf("#%d", rank),
+			Inline: true,
+		})
+	}
+
+	if !userStats.First.IsZero() {
+		fields = append(fields,
+			&discordgo.MessageEmbedField{Name: "First play", Value: formatPlayTime(userStats.First), Inline: true},
+			&discordgo.MessageEmbedField{Name: "Last play", Value: formatPlayTime(userStats.Last), Inline: true},
+		)
+	}
+
+	ctx.ReplyEmbed(&discordgo.MessageEmbed{
+		Title:  user.Username + "'s airhorns",
+		Color:  EMBED_COLOR,
+		Fields: fields,
+	})
+}
+
+func formatPlayTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 UTC") + ", " + humanize.Time(t)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/hammerandchisel/airhornbot/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	playsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "airhorn_plays_total",
+		Help: "Sounds played, by collection and sound",
+	}, []string{"collection", "sound"})
+
+	playsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "airhorn_plays_dropped_total",
+		Help: "Plays that were requested but never played, by reason",
+	}, []string{"reason"})
+
+	voiceJoinSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "airhorn_voice_join_seconds",
+		Help:    "How long joining or moving to a voice channel took",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	voiceJoinFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "airhorn_voice_join_failures_total",
+		Help: "Voice channels we failed to join",
+	})
+
+	soundLoadSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "airhorn_sound_load_seconds",
+		Help:    "How long loading and encoding a sound took, by collection",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"collection"})
+
+	gatewayReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "airhorn_gateway_reconnects_total",
+		Help: "Times the gateway connection was reestablished after the first connect",
+	})
+
+	queueDepthDesc = prometheus.NewDesc("airhorn_queue_depth",
+		"Plays waiting in guild queues, by priority", []string{"priority"}, nil)
+	voiceConnectionsDesc = prometheus.NewDesc("airhorn_voice_connections",
+		"Open voice connections", nil, nil)
+	guildsDesc = prometheus.NewDesc("airhorn_guilds",
+		"Guilds this shard serves", []string{"shard"}, nil)
+
+	// Whether we connected to the gateway before, so the next connect is a reconnect
+	gatewayConnected      bool
+	gatewayConnectedMutex sync.Mutex
+)
+
+// Reasons plays are dropped, as metric labels
+var dropReasons = map[error]string{
+	errNotInVoice:          "not_in_voice",
+	errCannotTarget:        "cannot_target",
+	errCannotPlay:          "missing_permissions",
+	errQueueFull:           "queue_full",
+	errVoiceChannelBlocked: "channel_blocked",
+	errOptedOut:            "opted_out",
+	errSoundNotAllowed:     "not_allowed",
+	errRateLimited:         "rate_limited",
+}
+
+const (
+	DROP_QUIET_HOURS = "quiet_hours"
+	DROP_SHUTDOWN    = "shutdown"
+)
+
+// Counts a play dropped because of err
+func countDroppedPlay(err error) {
+	reason, ok := dropReasons[err]
+	if !ok {
+		reason = "other"
+	}
+	playsDropped.WithLabelValues(reason).Inc()
+}
+
+// botCollector reads the bot's state whenever metrics are scraped
+type botCollector struct{}
+
+func (botCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- voiceConnectionsDesc
+	ch <- guildsDesc
+}
+
+func (botCollector) Collect(ch chan<- prometheus.Metric) {
+	_, lengths := queuedPlays()
+	for p, n := range lengths {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(n), Priority(p).String())
+	}
+
+	sinksMutex.Lock()
+	voice := len(sinks)
+	sinksMutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(voiceConnectionsDesc, prometheus.GaugeValue, float64(voice))
+
+	guilds := 0
+	for _, guild := range client.Guilds() {
+		if shardContains(guild.ID) {
+			guilds++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(guildsDesc, prometheus.GaugeValue, float64(guilds), shardDescription())
+}
+
+func onConnect(s *discordgo.Session, event *discordgo.Connect) {
+	gatewayConnectedMutex.Lock()
+	defer gatewayConnectedMutex.Unlock()
+
+	if gatewayConnected {
+		gatewayReconnects.Inc()
+	}
+	gatewayConnected = true
+}
+
+// Returns the address to serve metrics on. Supervised shard workers share
+// their flags, so each listens on the port after the previous shard's.
+func metricsAddr(addr string) (string, error) {
+	if supervisorAddr == "" {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+SHARD_ID)), nil
+}
+
+// Serves metrics on addr if it's set, once the client they read from exists
+func startMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	err := serveMetrics(addr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"addr":  addr,
+			"error": err,
+		}).Fatal("Failed to serve metrics")
+	}
+}
+
+// Serves prometheus metrics on /metrics, pprof on /debug/pprof/ and reads of
+// the stats store on /stats/store
+func serveMetrics(addr string) error {
+	addr, err := metricsAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	prometheus.MustRegister(playsCounter, playsDropped, voiceJoinSeconds, voiceJoinFailures,
+		soundLoadSeconds, gatewayReconnects, botCollector{})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle(stats.HTTP_STORE_PATH, stats.NewHandler(statsStore))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"addr": listener.Addr().String(),
+	}).Info("Serving metrics")
+
+	go func() {
+		err := http.Serve(listener, mux)
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Metrics listener stopped")
+	}()
+	return nil
+}
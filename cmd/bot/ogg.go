@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// Samples per channel in each 20ms Opus frame at 48kHz
+	opusFrameSize = 960
+
+	// Standard Opus encoder lookahead, written in the OpusHead pre-skip field
+	opusPreSkip = 312
+
+	oggHeaderBOS = 0x02
+	oggHeaderEOS = 0x04
+)
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(data []byte) (crc uint32) {
+	for _, b := range data {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggOpusWriter writes Opus packets into an Ogg container, one packet per page
+type oggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule uint64
+
+	// The last packet is held back so it can be written with the EOS flag
+	pending []byte
+}
+
+func newOggOpusWriter(w io.Writer, serial uint32, channels uint8) (*oggOpusWriter, error) {
+	o := &oggOpusWriter{w: w, serial: serial}
+
+	head := &bytes.Buffer{}
+	head.WriteString("OpusHead")
+	head.WriteByte(1)
+	head.WriteByte(channels)
+	binary.Write(head, binary.LittleEndian, uint16(opusPreSkip))
+	binary.Write(head, binary.LittleEndian, uint32(48000))
+	binary.Write(head, binary.LittleEndian, int16(0))
+	head.WriteByte(0)
+	if err := o.writePage(head.Bytes(), oggHeaderBOS); err != nil {
+		return nil, err
+	}
+
+	vendor := "airhornbot"
+	tags := &bytes.Buffer{}
+	tags.WriteString("OpusTags")
+	binary.Write(tags, binary.LittleEndian, uint32(len(vendor)))
+	tags.WriteString(vendor)
+	binary.Write(tags, binary.LittleEndian, uint32(0))
+	if err := o.writePage(tags.Bytes(), 0); err != nil {
+		return nil, err
+	}
+
+	o.granule = opusPreSkip
+	return o, nil
+}
+
+func (o *oggOpusWriter) WritePacket(opus []byte) error {
+	if o.pending != nil {
+		if err := o.writePage(o.pending, 0); err != nil {
+			return err
+		}
+	}
+
+	o.granule += opusFrameSize
+	o.pending = opus
+	return nil
+}
+
+func (o *oggOpusWriter) Close() error {
+	err := o.writePage(o.pending, oggHeaderEOS)
+	o.pending = nil
+	return err
+}
+
+func (o *oggOpusWriter) writePage(packet []byte, headerType byte) error {
+	// Lacing values, a packet is split into 255 byte segments followed by a shorter one
+	segments := make([]byte, 0, len(packet)/255+1)
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+
+	page := &bytes.Buffer{}
+	page.WriteString("OggS")
+	page.WriteByte(0)
+	page.WriteByte(headerType)
+	binary.Write(page, binary.LittleEndian, o.granule)
+	binary.Write(page, binary.LittleEndian, o.serial)
+	binary.Write(page, binary.LittleEndian, o.seq)
+	binary.Write(page, binary.LittleEndian, uint32(0))
+	page.WriteByte(byte(len(segments)))
+	page.Write(segments)
+	page.Write(packet)
+
+	data := page.Bytes()
+	binary.LittleEndian.PutUint32(data[22:26], oggCRC(data))
+
+	o.seq++
+	_, err := o.w.Write(data)
+	return err
+}
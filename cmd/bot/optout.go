@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Redis hash holding every user's opt-out, keyed by user ID
+	OPTOUT_KEY = "airhorn:optout"
+
+	// Refuse every play into a channel the user is in
+	OPTOUT_ALL = "all"
+
+	// Refuse plays into a channel the user is in unless they asked for it
+	OPTOUT_OTHERS = "others"
+
+	// Most users looked up in a single HMGET
+	OPTOUT_BATCH_SIZE = 1000
+)
+
+var (
+	errOptedOut = errors.New("Someone in that channel has opted out of sounds")
+
+	// Opt-outs by user ID, only used when we run without redis
+	localOptouts      = make(map[string]string)
+	localOptoutsMutex sync.Mutex
+)
+
+var optoutCommand = &Command{
+	Name:    "optout",
+	Usage:   "[all|others|off|count]",
+	MaxArgs: 1,
+	Help:    "Stops sounds playing in channels you're in, `others` still allows your own",
+	Level:   LevelUser,
+	Run:     runOptout,
+}
+
+// Returns the opt-out of each given user that has one
+func loadOptouts(userIDs []string) (map[string]string, error) {
+	optouts := make(map[string]string)
+	if len(userIDs) == 0 {
+		return optouts, nil
+	}
+
+	if rcli == nil {
+		localOptoutsMutex.Lock()
+		defer localOptoutsMutex.Unlock()
+
+		for _, id := range userIDs {
+			if mode, exists := localOptouts[id]; exists {
+				optouts[id] = mode
+			}
+		}
+		return optouts, nil
+	}
+
+	// Large guilds are looked up in batches to keep each reply small
+	for start := 0; start < len(userIDs); start += OPTOUT_BATCH_SIZE {
+		end := start + OPTOUT_BATCH_SIZE
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		values, err := rcli.HMGet(OPTOUT_KEY, userIDs[start:end]...).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, value := range values {
+			if mode, ok := value.(string); ok && mode != "" {
+				optouts[userIDs[start+i]] = mode
+			}
+		}
+	}
+	return optouts, nil
+}
+
+// Stores a user's opt-out, or removes it if mode is empty
+func storeOptout(userID, mode string) error {
+	if rcli == nil {
+		localOptoutsMutex.Lock()
+		defer localOptoutsMutex.Unlock()
+
+		if mode == "" {
+			delete(localOptouts, userID)
+		} else {
+			localOptouts[userID] = mode
+		}
+		return nil
+	}
+
+	if mode == "" {
+		return rcli.HDel(OPTOUT_KEY, userID).Err()
+	}
+	return rcli.HSet(OPTOUT_KEY, userID, mode).Err()
+}
+
+// Whether a play requested by userID may go into a voice channel, given the
+// opt-outs of everyone in it. Nobody can override an opt-out.
+func optoutsAllow(userID string, guild *discordgo.Guild, channel *discordgo.Channel) bool {
+	members := make([]string, 0)
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == channel.ID {
+			members = append(members, vs.UserID)
+		}
+	}
+
+	optouts, err := loadOptouts(members)
+	if err != nil {
+		// Err on the side of the people who asked not to be horned
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": channel.ID,
+			"error":   err,
+		}).Warning("Failed to load opt-outs")
+		return false
+	}
+
+	for id, mode := range optouts {
+		if mode == OPTOUT_ALL || (mode == OPTOUT_OTHERS && id != userID) {
+			return false
+		}
+	}
+	return true
+}
+
+func runOptout(ctx *CommandContext) {
+	user := ctx.Message.Author
+
+	if len(ctx.Args) == 0 {
+		optouts, err := loadOptouts([]string{user.ID})
+		if err != nil {
+			ctx.Reply("Failed to check your opt-out, try again in a bit")
+			return
+		}
+
+		switch optouts[user.ID] {
+		case OPTOUT_ALL:
+			ctx.Reply("Sounds never play in channels you're in")
+		case OPTOUT_OTHERS:
+			ctx.Reply("Only your own sounds play in channels you're in")
+		default:
+			ctx.Reply(fmt.Sprintf("You haven't opted out, use `%s all` or `%s others`", ctx.Invoked, ctx.Invoked))
+		}
+		return
+	}
+
+	var mode, reply string
+	switch ctx.Args[0] {
+	case OPTOUT_ALL:
+		mode, reply = OPTOUT_ALL, "Sounds won't play in channels you're in anymore"
+	case OPTOUT_OTHERS:
+		mode, reply = OPTOUT_OTHERS, "Only your own sounds will play in channels you're in"
+	case "off":
+		mode, reply = "", "Sounds can play in channels you're in again"
+	case "count":
+		displayOptoutCounts(ctx)
+		return
+	default:
+		ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+		return
+	}
+
+	err := storeOptout(user.ID, mode)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  user.ID,
+			"error": err,
+		}).Warning("Failed to store opt-out")
+		ctx.Reply("Failed to save that, try again in a bit")
+		return
+	}
+	ctx.Reply(reply)
+}
+
+// Shows admins how many of the guild's members opted out, without saying who
+func displayOptoutCounts(ctx *CommandContext) {
+	if ctx.Level < LevelAdmin {
+		return
+	}
+
+	members := make([]string, 0, len(ctx.Guild.Members))
+	for _, member := range ctx.Guild.Members {
+		if member.User != nil {
+			members = append(members, member.User.ID)
+		}
+	}
+
+	optouts, err := loadOptouts(members)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": ctx.Guild.ID,
+			"error": err,
+		}).Warning("Failed to load opt-outs")
+		ctx.Reply("Failed to count opt-outs, try again in a bit")
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, mode := range optouts {
+		counts[mode]++
+	}
+
+	ctx.Reply(fmt.Sprintf("Opted out of all sounds: %d\nOpted out of sounds they didn't play: %d",
+		counts[OPTOUT_ALL], counts[OPTOUT_OTHERS]))
+}
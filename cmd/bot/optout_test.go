@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Empties the local opt-outs for the length of a test
+func setupTestOptouts(t *testing.T) {
+	localOptoutsMutex.Lock()
+	old := localOptouts
+	localOptouts = make(map[string]string)
+	localOptoutsMutex.Unlock()
+
+	t.Cleanup(func() {
+		localOptoutsMutex.Lock()
+		localOptouts = old
+		localOptoutsMutex.Unlock()
+	})
+}
+
+func TestOptout(t *testing.T) {
+	state := setupTestBot(t)
+	setupTestOptouts(t)
+	guild := state.addGuild("610000000000000000")
+	text := guild.Channels[0].ID
+
+	cases := []struct {
+		mode  string
+		own   bool
+		other bool
+	}{
+		{"others", true, false},
+		{"all", false, false},
+		{"off", true, true},
+	}
+
+	played := 0
+	for _, c := range cases {
+		state.fake.Send("1", testUser, text, "!airhorn optout "+c.mode)
+
+		// The user and the admin share a channel
+		state.fake.Send("2", testUser, text, "!airhorn echo")
+		waitForPlays(t)
+		if sinks := state.guildSinks(guild.ID); (len(sinks) > played) != c.own {
+			t.Errorf("%s: user's own play was played %v, expected %v", c.mode, len(sinks) > played, c.own)
+		}
+		played = len(state.guildSinks(guild.ID))
+
+		// Admins can't override an opt-out either
+		state.fake.Send("3", testAdmin, text, "!airhorn echo")
+		waitForPlays(t)
+		if sinks := state.guildSinks(guild.ID); (len(sinks) > played) != c.other {
+			t.Errorf("%s: admin's play was played %v, expected %v", c.mode, len(sinks) > played, c.other)
+		}
+		played = len(state.guildSinks(guild.ID))
+	}
+}
+
+func TestOptoutCount(t *testing.T) {
+	state := setupTestBot(t)
+	setupTestOptouts(t)
+	guild := state.addGuild("620000000000000000")
+	text := guild.Channels[0].ID
+
+	storeOptout(testUser.ID, OPTOUT_ALL)
+	storeOptout(testOwner.ID, OPTOUT_OTHERS)
+	storeOptout("999", OPTOUT_ALL)
+
+	// Only members are counted, and only admins can see it
+	state.fake.Send("1", testUser, text, "!airhorn optout count")
+	state.fake.Send("2", testAdmin, text, "!airhorn optout count")
+	messages := state.fake.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0].Content, "all sounds: 1") ||
+		!strings.Contains(messages[0].Content, "didn't play: 1") {
+		t.Errorf("Opt-out count replied %v, expected one of each", messages)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hammerandchisel/airhornbot/plays"
+)
+
+// Publishes every play to a redis stream, nil when there's no redis or the
+// stream is turned off
+var playPublisher *plays.Publisher
+
+// Starts publishing plays to stream, keeping roughly maxLen of them for up to
+// maxAge (0 for either means no limit)
+func openPlayStream(stream string, maxLen int64, maxAge time.Duration) {
+	if rcli == nil || stream == "" {
+		return
+	}
+
+	playPublisher = plays.NewPublisher(rcli, stream)
+	playPublisher.MaxLen = maxLen
+	playPublisher.MaxAge = maxAge
+
+	log.WithFields(log.Fields{
+		"stream":  stream,
+		"max_len": maxLen,
+		"max_age": maxAge,
+	}).Info("Publishing plays")
+}
+
+// Publishes a play that started at started, chain is its position in a chain
+// of sounds
+func publishPlay(play *Play, chain int, started time.Time) {
+	if playPublisher == nil {
+		return
+	}
+
+	err := playPublisher.Publish(&plays.Event{
+		Time:       started,
+		GuildID:    play.GuildID,
+		ChannelID:  play.ChannelID,
+		UserID:     play.UserID,
+		Collection: play.Collection.Prefix,
+		Sound:      play.Sound.Name,
+		Forced:     play.Forced,
+		Chain:      chain,
+		Shard:      shardDescription(),
+		Latency:    started.Sub(play.Requested),
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": play.GuildID,
+			"error": err,
+		}).Warning("Failed to publish play")
+	}
+}
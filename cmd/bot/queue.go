@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+)
+
+// Priority is the lane a play is queued in, lower values are played first
+type Priority int
+
+const (
+	// Plays requested by the bot owner or a guild admin
+	PriorityAdmin Priority = iota
+
+	// Plays deferred until a guild's quiet hours end
+	PriorityScheduled
+
+	// Plays requested by a regular user
+	PriorityUser
+
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{
+	PriorityAdmin:     "admin",
+	PriorityScheduled: "scheduled",
+	PriorityUser:      "user",
+}
+
+func (p Priority) String() string {
+	if p < 0 || p >= numPriorities {
+		return "unknown"
+	}
+	return priorityNames[p]
+}
+
+// PlayQueue is a per-guild queue of plays, split into one FIFO lane per priority
+type PlayQueue struct {
+	sync.Mutex
+
+	lanes [numPriorities][]*Play
+
+	// If true, forced plays are taken before random plays within the same lane
+	forcedFirst bool
+}
+
+func NewPlayQueue(forcedFirst bool) *PlayQueue {
+	return &PlayQueue{forcedFirst: forcedFirst}
+}
+
+// Push adds a play to the end of its lane, returns false if the queue already
+// holds limit plays
+func (q *PlayQueue) Push(play *Play, limit int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.length() >= limit {
+		return false
+	}
+
+	q.lanes[play.Priority] = append(q.lanes[play.Priority], play)
+	return true
+}
+
+// Pop removes and returns the next play to occur, or nil if the queue is empty
+func (q *PlayQueue) Pop() *Play {
+	q.Lock()
+	defer q.Unlock()
+
+	for p, lane := range q.lanes {
+		if len(lane) == 0 {
+			continue
+		}
+
+		idx := 0
+		if q.forcedFirst {
+			for i, play := range lane {
+				if play.Forced {
+					idx = i
+					break
+				}
+			}
+		}
+
+		play := lane[idx]
+		q.lanes[p] = append(lane[:idx], lane[idx+1:]...)
+		return play
+	}
+	return nil
+}
+
+// Len returns the total number of queued plays
+func (q *PlayQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.length()
+}
+
+// Lengths returns the number of queued plays in each lane
+func (q *PlayQueue) Lengths() (lengths [numPriorities]int) {
+	q.Lock()
+	defer q.Unlock()
+
+	for p, lane := range q.lanes {
+		lengths[p] = len(lane)
+	}
+	return lengths
+}
+
+func (q *PlayQueue) length() (n int) {
+	for _, lane := range q.lanes {
+		n += len(lane)
+	}
+	return n
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+// Pops every play, returning their user IDs in order
+func popAll(q *PlayQueue) []string {
+	order := make([]string, 0)
+	for play := q.Pop(); play != nil; play = q.Pop() {
+		order = append(order, play.UserID)
+	}
+	return order
+}
+
+func equalOrder(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPlayQueueOrder(t *testing.T) {
+	plays := []*Play{
+		{UserID: "user1", Priority: PriorityUser},
+		{UserID: "scheduled1", Priority: PriorityScheduled},
+		{UserID: "user2", Priority: PriorityUser, Forced: true},
+		{UserID: "admin1", Priority: PriorityAdmin},
+		{UserID: "scheduled2", Priority: PriorityScheduled, Forced: true},
+		{UserID: "admin2", Priority: PriorityAdmin},
+	}
+
+	cases := []struct {
+		forcedFirst bool
+		order       []string
+	}{
+		{false, []string{"admin1", "admin2", "scheduled1", "scheduled2", "user1", "user2"}},
+		{true, []string{"admin1", "admin2", "scheduled2", "scheduled1", "user2", "user1"}},
+	}
+
+	for _, c := range cases {
+		q := NewPlayQueue(c.forcedFirst)
+		for _, play := range plays {
+			if !q.Push(play, len(plays)) {
+				t.Fatalf("Queue refused %s", play.UserID)
+			}
+		}
+
+		if lengths := q.Lengths(); lengths[PriorityAdmin] != 2 || lengths[PriorityScheduled] != 2 || lengths[PriorityUser] != 2 {
+			t.Errorf("Lanes hold %v, expected 2 plays each", lengths)
+		}
+
+		if order := popAll(q); !equalOrder(order, c.order) {
+			t.Errorf("Forced first %v played %v, expected %v", c.forcedFirst, order, c.order)
+		}
+
+		if q.Len() != 0 {
+			t.Errorf("Queue still holds %d plays", q.Len())
+		}
+	}
+}
+
+func TestPlayQueueLimit(t *testing.T) {
+	q := NewPlayQueue(false)
+	if !q.Push(&Play{UserID: "user1", Priority: PriorityUser}, 2) ||
+		!q.Push(&Play{UserID: "user2", Priority: PriorityUser}, 2) {
+		t.Fatal("Queue refused plays under its limit")
+	}
+
+	// The limit covers every lane, admins included
+	if q.Push(&Play{UserID: "admin1", Priority: PriorityAdmin}, 2) {
+		t.Error("Queue took a play over its limit")
+	}
+
+	q.Pop()
+	if !q.Push(&Play{UserID: "admin1", Priority: PriorityAdmin}, 2) {
+		t.Error("Queue refused a play after one was popped")
+	}
+
+	if order := popAll(q); !equalOrder(order, []string{"admin1", "user2"}) {
+		t.Errorf("Queue played %v, expected admin1 then user2", order)
+	}
+}
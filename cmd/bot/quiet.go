@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// What happens to plays during quiet hours, they're rejected, queued until the
+// quiet hours end or only allowed for members of the quiet roles
+const (
+	QUIET_REJECT = "reject"
+	QUIET_QUEUE  = "queue"
+	QUIET_ROLE   = "role"
+)
+
+// quietWindow is a daily window of quiet hours, as minutes since midnight in
+// the guild's timezone. Windows ending before they start run past midnight.
+type quietWindow struct {
+	Start int
+	End   int
+}
+
+// deferredPlay is a play waiting for its guild's quiet hours to end
+type deferredPlay struct {
+	UserID string
+	Until  time.Time
+	timer  *time.Timer
+}
+
+var (
+	// Plays waiting for quiet hours to end, by guild ID
+	deferredPlays      = make(map[string][]*deferredPlay)
+	deferredPlaysMutex sync.Mutex
+)
+
+func (w quietWindow) contains(minute int) bool {
+	if w.Start <= w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+func (w quietWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// Parses a window given as HH:MM-HH:MM
+func parseQuietWindow(value string) (quietWindow, error) {
+	var w quietWindow
+	var startHour, startMinute, endHour, endMinute int
+
+	_, err := fmt.Sscanf(value, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute)
+	if err != nil || startHour > 23 || endHour > 24 || startMinute > 59 || endMinute > 59 ||
+		startHour < 0 || endHour < 0 || startMinute < 0 || endMinute < 0 ||
+		(endHour == 24 && endMinute != 0) {
+		return w, fmt.Errorf("quiet hours are given as HH:MM-HH:MM, e.g. 23:00-07:30")
+	}
+
+	w.Start, w.End = startHour*60+startMinute, endHour*60+endMinute
+	if w.Start == w.End {
+		return w, fmt.Errorf("quiet hours can't start and end at the same time")
+	}
+	return w, nil
+}
+
+func parseQuietHoursSetting(guild *discordgo.Guild, args []string) (string, error) {
+	items := splitArgs(args)
+	if len(items) == 1 && items[0] == "none" {
+		return "", nil
+	}
+
+	windows := make([]string, 0, len(items))
+	for _, item := range items {
+		w, err := parseQuietWindow(item)
+		if err != nil {
+			return "", err
+		}
+		windows = append(windows, w.String())
+	}
+	return strings.Join(windows, ","), nil
+}
+
+func parseTimezoneSetting(guild *discordgo.Guild, args []string) (string, error) {
+	name := strings.Join(args, "")
+	if _, err := time.LoadLocation(name); err != nil || name == "" {
+		return "", fmt.Errorf("timezones are IANA names, e.g. Europe/Berlin or America/New_York")
+	}
+	return name, nil
+}
+
+// Returns when the guild's quiet hours end if they're on at the given time
+func (s *GuildSettings) QuietUntil(now time.Time) (time.Time, bool) {
+	now = now.In(s.Location)
+	until, quiet := now, false
+
+	// Follow windows that overlap or run into each other
+	for i := 0; i <= len(s.QuietHours); i++ {
+		minute := until.Hour()*60 + until.Minute()
+
+		found := false
+		for _, w := range s.QuietHours {
+			if !w.contains(minute) {
+				continue
+			}
+
+			end := time.Date(until.Year(), until.Month(), until.Day(), w.End/60, w.End%60, 0, 0, s.Location)
+			if !end.After(until) {
+				end = end.AddDate(0, 0, 1)
+			}
+
+			until, quiet, found = end, true, true
+			break
+		}
+
+		if !found {
+			break
+		}
+	}
+	return until, quiet
+}
+
+// Describes the guild's quiet hours for help output, empty if it has none
+func (s *GuildSettings) QuietDescription(now time.Time) string {
+	if len(s.QuietHours) == 0 {
+		return ""
+	}
+
+	windows := make([]string, 0, len(s.QuietHours))
+	for _, w := range s.QuietHours {
+		windows = append(windows, w.String())
+	}
+
+	description := fmt.Sprintf("Quiet hours are %s (%s)", strings.Join(windows, ", "), s.Location)
+	if until, quiet := s.QuietUntil(now); quiet {
+		switch s.QuietMode {
+		case QUIET_QUEUE:
+			description += fmt.Sprintf(", on until %s, sounds wait until then", until.Format("15:04"))
+		case QUIET_ROLE:
+			description += fmt.Sprintf(", on until %s, only some roles can play sounds", until.Format("15:04"))
+		default:
+			description += fmt.Sprintf(", on until %s, sounds can't be played", until.Format("15:04"))
+		}
+	}
+	return description
+}
+
+// Runs play once the guild's quiet hours end, returns false if the guild
+// already has as many plays waiting as fit in its queue
+func deferPlay(guildID, userID string, until time.Time, limit int, play func()) bool {
+	deferredPlaysMutex.Lock()
+	defer deferredPlaysMutex.Unlock()
+
+	if len(deferredPlays[guildID]) >= limit {
+		return false
+	}
+
+	deferred := &deferredPlay{UserID: userID, Until: until}
+	deferred.timer = time.AfterFunc(until.Sub(time.Now()), func() {
+		// Plays dropped on shutdown have already been counted
+		if !removeDeferredPlay(guildID, deferred) {
+			return
+		}
+
+		if !trackPlay(play) {
+			playsDropped.WithLabelValues(DROP_SHUTDOWN).Inc()
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"user":  userID,
+			}).Warning("Dropping play deferred by quiet hours, shutting down")
+		}
+	})
+	deferredPlays[guildID] = append(deferredPlays[guildID], deferred)
+	return true
+}
+
+// Stops tracking a deferred play, returns false if it wasn't tracked
+func removeDeferredPlay(guildID string, deferred *deferredPlay) bool {
+	deferredPlaysMutex.Lock()
+	defer deferredPlaysMutex.Unlock()
+
+	waiting := deferredPlays[guildID]
+	for i, d := range waiting {
+		if d != deferred {
+			continue
+		}
+
+		waiting = append(waiting[:i], waiting[i+1:]...)
+		if len(waiting) == 0 {
+			delete(deferredPlays, guildID)
+		} else {
+			deferredPlays[guildID] = waiting
+		}
+		return true
+	}
+	return false
+}
+
+// Stops every play still waiting for quiet hours to end and logs it as dropped
+func dropDeferredPlays() {
+	deferredPlaysMutex.Lock()
+	defer deferredPlaysMutex.Unlock()
+
+	for guildID, waiting := range deferredPlays {
+		remaining := waiting[:0]
+		for _, d := range waiting {
+			// Timers that already fired drop their own play
+			if !d.timer.Stop() {
+				remaining = append(remaining, d)
+				continue
+			}
+
+			playsDropped.WithLabelValues(DROP_SHUTDOWN).Inc()
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"user":  d.UserID,
+				"until": d.Until,
+			}).Warning("Dropping play deferred by quiet hours on shutdown")
+		}
+
+		if len(remaining) == 0 {
+			delete(deferredPlays, guildID)
+		} else {
+			deferredPlays[guildID] = remaining
+		}
+	}
+}
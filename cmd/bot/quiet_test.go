@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietWindow(t *testing.T) {
+	cases := []struct {
+		value string
+		start int
+		end   int
+		valid bool
+	}{
+		{"23:00-07:30", 23 * 60, 7*60 + 30, true},
+		{"00:00-24:00", 0, 24 * 60, true},
+		{"12:15-12:45", 12*60 + 15, 12*60 + 45, true},
+		{"22:00-24:30", 0, 0, false},
+		{"24:00-06:00", 0, 0, false},
+		{"10:60-11:00", 0, 0, false},
+		{"10:00-10:00", 0, 0, false},
+		{"-1:00-10:00", 0, 0, false},
+		{"10-11", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		w, err := parseQuietWindow(c.value)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: got error %v, expected valid %v", c.value, err, c.valid)
+			continue
+		}
+
+		if c.valid && (w.Start != c.start || w.End != c.end) {
+			t.Errorf("%q parsed as %d-%d, expected %d-%d", c.value, w.Start, w.End, c.start, c.end)
+		}
+	}
+}
+
+func TestQuietUntil(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("No timezone data: ", err)
+	}
+
+	window := func(value string) quietWindow {
+		w, err := parseQuietWindow(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	utc := func(hour, minute int) time.Time {
+		return time.Date(2016, time.June, 10, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name     string
+		windows  []quietWindow
+		location *time.Location
+		now      time.Time
+		until    time.Time
+		quiet    bool
+	}{
+		{"before", []quietWindow{window("23:00-07:00")}, time.UTC, utc(22, 59), time.Time{}, false},
+		{"start", []quietWindow{window("23:00-07:00")}, time.UTC, utc(23, 0), utc(7, 0).AddDate(0, 0, 1), true},
+		{"after midnight", []quietWindow{window("23:00-07:00")}, time.UTC, utc(3, 0), utc(7, 0), true},
+		{"end", []quietWindow{window("23:00-07:00")}, time.UTC, utc(7, 0), time.Time{}, false},
+		{"until midnight", []quietWindow{window("22:00-24:00")}, time.UTC, utc(23, 30), utc(0, 0).AddDate(0, 0, 1), true},
+		{"after 24:00", []quietWindow{window("22:00-24:00")}, time.UTC, utc(0, 30), time.Time{}, false},
+		{"run together", []quietWindow{window("22:00-24:00"), window("00:00-06:00")}, time.UTC, utc(23, 0), utc(6, 0).AddDate(0, 0, 1), true},
+		{"overlap", []quietWindow{window("12:00-14:00"), window("13:00-15:00")}, time.UTC, utc(12, 30), utc(15, 0), true},
+
+		// Berlin is UTC+2 in June
+		{"timezone quiet", []quietWindow{window("23:00-07:00")}, berlin, utc(21, 30), utc(5, 0).AddDate(0, 0, 1), true},
+		{"timezone not quiet", []quietWindow{window("23:00-07:00")}, berlin, utc(5, 30), time.Time{}, false},
+	}
+
+	for _, c := range cases {
+		settings := &GuildSettings{QuietHours: c.windows, Location: c.location}
+		until, quiet := settings.QuietUntil(c.now)
+		if quiet != c.quiet {
+			t.Errorf("%s: quiet is %v, expected %v", c.name, quiet, c.quiet)
+			continue
+		}
+
+		if quiet && !until.Equal(c.until) {
+			t.Errorf("%s: quiet until %s, expected %s", c.name, until.UTC(), c.until)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Role rules are stored in the settings hash as role.<role id>
+const ROLE_FIELD_PREFIX = "role."
+
+// How often plays too old to limit anyone are forgotten
+const PLAY_RATE_SWEEP_INTERVAL = time.Minute
+
+// rateTier limits how often a member may play sounds
+type rateTier struct {
+	Name     string
+	Cooldown time.Duration
+}
+
+// Rate limit tiers, from most to least permissive
+var RATE_TIERS = []rateTier{
+	{"unlimited", 0},
+	{"fast", 2 * time.Second},
+	{"normal", 10 * time.Second},
+	{"slow", 30 * time.Second},
+}
+
+// RoleRule is what a guild grants the members of one role. Collections and
+// sounds listed in any rule may only be played by members of a role listing
+// them, everything else stays open to everyone.
+type RoleRule struct {
+	// Prefixes of the collections the role may play
+	Collections []string `json:"collections,omitempty"`
+
+	// Sounds the role may play, as <collection prefix>/<sound name>
+	Sounds []string `json:"sounds,omitempty"`
+
+	// Rate limit tier for members of the role
+	Tier string `json:"tier,omitempty"`
+
+	// If set, members of the role may run admin commands
+	Manage bool `json:"manage,omitempty"`
+}
+
+var (
+	errSoundNotAllowed = errors.New("Your roles can't play any of those sounds")
+	errRateLimited     = errors.New("Slow down, you're playing sounds too quickly")
+
+	// When each member last played a sound, by guild and user ID
+	lastPlays      = make(map[string]time.Time)
+	lastPlaysMutex sync.Mutex
+)
+
+var roleCommand = &Command{
+	Name:  "role",
+	Usage: "list|set|reset",
+	Help:  "Shows or changes what roles may do",
+	Level: LevelAdmin,
+	Subcommands: []*Command{
+		{
+			Name:  "list",
+			Help:  "Shows the rules for every role",
+			Level: LevelAdmin,
+			Run:   runRoleList,
+		},
+		{
+			Name:    "set",
+			Usage:   "<role> collections|sounds|tier|manage <value>",
+			MinArgs: 3,
+			MaxArgs: -1,
+			Help:    "Grants a role collections, sounds (as airhorn/echo), a rate limit tier or admin commands",
+			Level:   LevelAdmin,
+			Run:     runRoleSet,
+		},
+		{
+			Name:    "reset",
+			Usage:   "<role>",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Help:    "Removes a role's rules",
+			Level:   LevelAdmin,
+			Run:     runRoleReset,
+		},
+	},
+}
+
+func findRateTier(name string) (rateTier, bool) {
+	for _, tier := range RATE_TIERS {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+	return rateTier{}, false
+}
+
+func rateTierNames() []string {
+	names := make([]string, 0, len(RATE_TIERS))
+	for _, tier := range RATE_TIERS {
+		names = append(names, tier.Name)
+	}
+	return names
+}
+
+// Returns the IDs of a member's roles, including @everyone which shares the
+// guild's ID
+func memberRoles(guildID, userID string) []string {
+	roles := []string{guildID}
+
+	member, err := client.Member(guildID, userID)
+	if err != nil || member == nil {
+		return roles
+	}
+	return append(roles, member.Roles...)
+}
+
+// Returns the rules for the roles a member has
+func (s *GuildSettings) memberRules(roles []string) []*RoleRule {
+	rules := make([]*RoleRule, 0)
+	for _, role := range roles {
+		if rule, exists := s.Roles[role]; exists {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Whether a member may use the bot at all, when the guild limits it to some roles
+func (s *GuildSettings) HasRequiredRole(roles []string) bool {
+	return len(s.OnlyRoles) == 0 || hasAnyRole(roles, s.OnlyRoles)
+}
+
+func hasAnyRole(roles, wanted []string) bool {
+	for _, role := range roles {
+		if scontains(role, wanted...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a member's roles grant them admin commands
+func (s *GuildSettings) CanManage(roles []string) bool {
+	for _, rule := range s.memberRules(roles) {
+		if rule.Manage {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a member may play a collection, or sound from it. Items no rule
+// lists are open to everyone.
+func (s *GuildSettings) roleAllows(roles []string, item string, list func(rule *RoleRule) []string) bool {
+	restricted := false
+	for _, rule := range s.Roles {
+		if scontains(item, list(rule)...) {
+			restricted = true
+			break
+		}
+	}
+
+	if !restricted {
+		return true
+	}
+
+	for _, rule := range s.memberRules(roles) {
+		if scontains(item, list(rule)...) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *GuildSettings) CollectionAllowed(roles []string, coll *SoundCollection) bool {
+	return s.roleAllows(roles, coll.Prefix, func(rule *RoleRule) []string { return rule.Collections })
+}
+
+func (s *GuildSettings) SoundAllowed(roles []string, coll *SoundCollection, sound *Sound) bool {
+	return s.roleAllows(roles, coll.Prefix+"/"+sound.Name, func(rule *RoleRule) []string { return rule.Sounds })
+}
+
+// Returns a member's rate limit tier, the most permissive of the guild's
+// and their roles'
+func (s *GuildSettings) MemberTier(roles []string) rateTier {
+	tier, _ := findRateTier(s.RateLimit)
+	for _, rule := range s.memberRules(roles) {
+		if t, ok := findRateTier(rule.Tier); ok && t.Cooldown < tier.Cooldown {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// Records a play by a member, returns false if they played one within their
+// tier's cooldown
+func allowPlayRate(guildID, userID string, tier rateTier) bool {
+	if tier.Cooldown == 0 {
+		return true
+	}
+
+	key := guildID + ":" + userID
+	now := time.Now()
+
+	lastPlaysMutex.Lock()
+	defer lastPlaysMutex.Unlock()
+
+	if last, exists := lastPlays[key]; exists && now.Sub(last) < tier.Cooldown {
+		return false
+	}
+
+	lastPlays[key] = now
+	return true
+}
+
+// Forgets a member's play that was recorded but never played, so it doesn't
+// count against their cooldown
+func refundPlayRate(guildID, userID string) {
+	lastPlaysMutex.Lock()
+	delete(lastPlays, guildID+":"+userID)
+	lastPlaysMutex.Unlock()
+}
+
+// Forgets plays old enough that they can't limit anyone, until we shut down
+func sweepPlayRatesLoop() {
+	slowest := RATE_TIERS[len(RATE_TIERS)-1].Cooldown
+	for {
+		select {
+		case <-time.After(PLAY_RATE_SWEEP_INTERVAL):
+		case <-shutdown:
+			return
+		}
+
+		now := time.Now()
+		lastPlaysMutex.Lock()
+		for key, last := range lastPlays {
+			if now.Sub(last) > slowest {
+				delete(lastPlays, key)
+			}
+		}
+		lastPlaysMutex.Unlock()
+	}
+}
+
+// Returns a random sound from a collection out of the ones a member may play,
+// weighted like Random
+func (s *SoundCollection) RandomWhere(allowed func(sound *Sound) bool) *Sound {
+	total := 0
+	for _, sound := range s.Sounds {
+		if allowed(sound) {
+			total += sound.Weight
+		}
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	i, number := 0, randomRange(0, total)
+	for _, sound := range s.Sounds {
+		if !allowed(sound) {
+			continue
+		}
+
+		i += sound.Weight
+		if number < i {
+			return sound
+		}
+	}
+	return nil
+}
+
+// Attempts to find a role inside a given guild from a role mention or name
+func findRole(ref string, guild *discordgo.Guild) *discordgo.Role {
+	for _, role := range guild.Roles {
+		name := strings.ToLower(role.Name)
+		if ref == "<@&"+role.ID+">" || ref == name || strings.TrimPrefix(ref, "@") == name {
+			return role
+		}
+	}
+	return nil
+}
+
+func roleName(roleID string, guild *discordgo.Guild) string {
+	for _, role := range guild.Roles {
+		if role.ID == roleID {
+			return role.Name
+		}
+	}
+	return roleID
+}
+
+// Loads a stored role rule into settings
+func applyRoleRule(s *GuildSettings, roleID, value string) {
+	rule := &RoleRule{}
+	err := json.Unmarshal([]byte(value), rule)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": s.GuildID,
+			"role":  roleID,
+			"error": err,
+		}).Warning("Invalid role rule")
+		return
+	}
+	s.Roles[roleID] = rule
+}
+
+// Builds a setting holding a list of role IDs, empty is the value used to
+// clear the list
+func roleListSetting(name, help, empty string, field func(s *GuildSettings) *[]string) *setting {
+	return &setting{
+		Name:  name,
+		Usage: "<role...>|" + empty,
+		Help:  help,
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			items := splitArgs(args)
+			if len(items) == 1 && items[0] == empty {
+				return "", nil
+			}
+
+			ids := make([]string, 0, len(items))
+			for _, item := range items {
+				role := findRole(item, guild)
+				if role == nil {
+					return "", fmt.Errorf("there's no role `%s`", item)
+				}
+
+				if !scontains(role.ID, ids...) {
+					ids = append(ids, role.ID)
+				}
+			}
+			return strings.Join(ids, ","), nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			*field(s) = splitList(value)
+		},
+		format: func(s *GuildSettings) string {
+			ids := *field(s)
+			if len(ids) == 0 {
+				return empty
+			}
+
+			guild, _ := client.Guild(s.GuildID)
+			names := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if guild != nil {
+					names = append(names, roleName(id, guild))
+				} else {
+					names = append(names, id)
+				}
+			}
+			return strings.Join(names, ", ")
+		},
+	}
+}
+
+// Parses sounds given as <collection>/<sound> into their stored form
+func parseRoleSounds(items []string) ([]string, error) {
+	sounds := make([]string, 0, len(items))
+	for _, item := range items {
+		parts := strings.SplitN(item, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("sounds are given as collection/sound, e.g. airhorn/echo")
+		}
+
+		coll := findCollection(parts[0])
+		if coll == nil {
+			return nil, fmt.Errorf("there's no collection named `%s`", parts[0])
+		}
+
+		var found *Sound
+		for _, sound := range coll.Sounds {
+			if sound.Name == parts[1] {
+				found = sound
+			}
+		}
+
+		if found == nil {
+			return nil, fmt.Errorf("there's no sound `%s` in `%s`", parts[1], parts[0])
+		}
+		sounds = append(sounds, coll.Prefix+"/"+found.Name)
+	}
+	return sounds, nil
+}
+
+// Formats a stored sound as <collection command>/<sound>
+func formatRoleSound(sound string) string {
+	parts := strings.SplitN(sound, "/", 2)
+	if len(parts) != 2 {
+		return sound
+	}
+	return collectionName(parts[0]) + "/" + parts[1]
+}
+
+func formatRoleRule(rule *RoleRule) string {
+	parts := make([]string, 0, 4)
+	if len(rule.Collections) > 0 {
+		names := make([]string, 0, len(rule.Collections))
+		for _, prefix := range rule.Collections {
+			names = append(names, collectionName(prefix))
+		}
+		parts = append(parts, "collections "+strings.Join(names, ", "))
+	}
+
+	if len(rule.Sounds) > 0 {
+		sounds := make([]string, 0, len(rule.Sounds))
+		for _, sound := range rule.Sounds {
+			sounds = append(sounds, formatRoleSound(sound))
+		}
+		parts = append(parts, "sounds "+strings.Join(sounds, ", "))
+	}
+
+	if rule.Tier != "" {
+		parts = append(parts, "tier "+rule.Tier)
+	}
+
+	if rule.Manage {
+		parts = append(parts, "manage")
+	}
+
+	if len(parts) == 0 {
+		return "nothing"
+	}
+	return strings.Join(parts, "; ")
+}
+
+func runRoleList(ctx *CommandContext) {
+	if len(ctx.Settings.Roles) == 0 {
+		ctx.Reply("No roles have rules, everyone can play every sound")
+		return
+	}
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	for _, role := range ctx.Guild.Roles {
+		if rule, exists := ctx.Settings.Roles[role.ID]; exists {
+			fmt.Fprintf(w, "%s:\t%s\n", role.Name, formatRoleRule(rule))
+		}
+	}
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	ctx.Reply(buf.String())
+}
+
+func runRoleSet(ctx *CommandContext) {
+	role := findRole(ctx.Args[0], ctx.Guild)
+	if role == nil {
+		ctx.Reply(fmt.Sprintf("There's no role `%s`", ctx.Args[0]))
+		return
+	}
+
+	rule := &RoleRule{}
+	if existing, exists := ctx.Settings.Roles[role.ID]; exists {
+		*rule = *existing
+	}
+
+	values := splitArgs(ctx.Args[2:])
+	none := len(values) == 1 && values[0] == "none"
+
+	switch ctx.Args[1] {
+	case "collections":
+		rule.Collections = nil
+		for _, name := range values {
+			if none {
+				break
+			}
+
+			coll := findCollection(name)
+			if coll == nil {
+				ctx.Reply(fmt.Sprintf("There's no collection named `%s`", name))
+				return
+			}
+			rule.Collections = append(rule.Collections, coll.Prefix)
+		}
+	case "sounds":
+		rule.Sounds = nil
+		if !none {
+			sounds, err := parseRoleSounds(values)
+			if err != nil {
+				ctx.Reply(fmt.Sprintf("Usage: `%s`, %s", commandUsage(ctx.Invoked, ctx.Command), err))
+				return
+			}
+			rule.Sounds = sounds
+		}
+	case "tier":
+		rule.Tier = ""
+		if !none {
+			if _, ok := findRateTier(strings.Join(values, "")); !ok {
+				ctx.Reply(fmt.Sprintf("Tiers are %s or none", strings.Join(rateTierNames(), ", ")))
+				return
+			}
+			rule.Tier = strings.Join(values, "")
+		}
+	case "manage":
+		value := strings.Join(values, "")
+		if value != "on" && value != "off" {
+			ctx.Reply("manage is either on or off")
+			return
+		}
+		rule.Manage = value == "on"
+	default:
+		ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+		return
+	}
+
+	data, _ := json.Marshal(rule)
+	err := storeSetting(ctx.Guild.ID, ROLE_FIELD_PREFIX+role.ID, string(data))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": ctx.Guild.ID,
+			"role":  role.ID,
+			"error": err,
+		}).Warning("Failed to store role rule")
+		ctx.Reply("Failed to save that rule, try again in a bit")
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("%s can now use %s", role.Name, formatRoleRule(rule)))
+}
+
+func runRoleReset(ctx *CommandContext) {
+	role := findRole(ctx.Args[0], ctx.Guild)
+	if role == nil {
+		ctx.Reply(fmt.Sprintf("There's no role `%s`", ctx.Args[0]))
+		return
+	}
+
+	err := storeSetting(ctx.Guild.ID, ROLE_FIELD_PREFIX+role.ID, "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": ctx.Guild.ID,
+			"role":  role.ID,
+			"error": err,
+		}).Warning("Failed to remove role rule")
+		ctx.Reply("Failed to remove that rule, try again in a bit")
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("Removed the rules for %s", role.Name))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlayRateRefund(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("450000000000000000")
+	text, general := guild.Channels[0].ID, guild.Channels[1].ID
+
+	defer invalidateSettings(guild.ID)
+	if err := storeSetting(guild.ID, "rate_limit", "slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A play that can't happen doesn't use up the cooldown
+	state.fake.SetVoiceChannel(guild.ID, testUser.ID, "")
+	state.fake.Send("1", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	state.fake.SetVoiceChannel(guild.ID, testUser.ID, general)
+	state.fake.Send("2", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Fatalf("Played %d times after a refunded play, expected 1", len(sinks))
+	}
+
+	// A play that happened does
+	state.fake.Send("3", testUser, text, "!airhorn")
+	waitForPlays(t)
+
+	if sinks := state.guildSinks(guild.ID); len(sinks) != 1 {
+		t.Fatalf("Played %d times within the cooldown, expected 1", len(sinks))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hammerandchisel/airhornbot/stats"
+)
+
+const (
+	// Most points the series command shows, so the reply fits in a message
+	MAX_SERIES_POINTS = 48
+
+	// Width of the longest bar in the series command's chart
+	SERIES_BAR_WIDTH = 30
+)
+
+func init() {
+	registerCommand(&Command{
+		Name:    "series",
+		Usage:   "[minute|hour|day] [total|sound:<name>|guild:<id>|here] [points]",
+		MaxArgs: 3,
+		Help:    "Charts plays over time, by default for every play over the last 24 hours",
+		Level:   LevelOwner,
+		Run:     runSeries,
+	})
+}
+
+func runSeries(ctx *CommandContext) {
+	res, series, n := stats.Hour, stats.TOTAL_SERIES, 24
+	for _, arg := range ctx.RawArgs() {
+		if r := stats.FindResolution(strings.ToLower(arg)); r != nil {
+			res = r
+		} else if count, err := strconv.Atoi(arg); err == nil {
+			n = count
+		} else if strings.ToLower(arg) == "here" {
+			series = stats.GuildSeries(ctx.Guild.ID)
+		} else {
+			series = arg
+		}
+	}
+
+	if err := stats.ValidSeries(series); err != nil {
+		ctx.Reply(fmt.Sprintf("Unknown series `%s`, %s", series, err))
+		return
+	}
+
+	if n < 1 || n > MAX_SERIES_POINTS {
+		ctx.Reply(fmt.Sprintf("Series can show 1 to %d points", MAX_SERIES_POINTS))
+		return
+	}
+
+	points, err := stats.QueryLast(statsStore, res, series, n)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"resolution": res.Name,
+			"series":     series,
+			"error":      err,
+		}).Warning("Failed to query stats series")
+		ctx.Reply("Failed to load that series, try again in a bit")
+		return
+	}
+
+	ctx.Reply(formatSeries(res, series, points))
+}
+
+// Formats a series as a table with a bar per point
+func formatSeries(res *stats.Resolution, series string, points []stats.Point) string {
+	var total, peak int64
+	for _, point := range points {
+		total += point.Count
+		if point.Count > peak {
+			peak = point.Count
+		}
+	}
+
+	layout := "15:04"
+	if res == stats.Day {
+		layout = "2006-01-02"
+	}
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "%s per %s (UTC)\n", series, res.Name)
+	for _, point := range points {
+		bar := 0
+		if peak > 0 {
+			bar = int(point.Count * SERIES_BAR_WIDTH / peak)
+		}
+		fmt.Fprintf(w, "%s\t%d\t %s\n", point.Time.Format(layout), point.Count, strings.Repeat("#", bar))
+	}
+	fmt.Fprintf(w, "Total\t%d\t\n", total)
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	return buf.String()
+}
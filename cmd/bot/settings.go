@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Redis channel guild IDs are published on when their settings change
+	SETTINGS_CHANNEL = "airhorn:settings"
+
+	// How long cached settings are trusted, in case we missed an invalidation
+	SETTINGS_CACHE_TTL = 5 * time.Minute
+
+	// Upper bound for the queue_size setting
+	MAX_GUILD_QUEUE_SIZE = 20
+
+	// Feedback styles, silent ignores commands that can't be played and text
+	// replies explaining why
+	FEEDBACK_SILENT = "silent"
+	FEEDBACK_TEXT   = "text"
+)
+
+// GuildSettings is the configuration of a single guild, any setting the guild
+// hasn't changed holds its default
+type GuildSettings struct {
+	GuildID string
+
+	// Prefixes of the collections that may be played, all of them if empty
+	Collections []string
+
+	// Prefixes commands start with, commands can only be run by mentioning
+	// the bot if empty
+	Prefixes []string
+
+	// Text channels commands are accepted in, all of them if empty, and text
+	// channels commands are ignored in
+	TextChannels        []string
+	BlockedTextChannels []string
+
+	// Voice channels sounds may be played in, all of them if empty, and voice
+	// channels they're never played in
+	VoiceChannels        []string
+	BlockedVoiceChannels []string
+
+	// Reply to commands blocked by the channel lists or OnlyRoles, if empty they're ignored
+	BlockedMessage string
+
+	QueueSize int
+	Feedback  string
+
+	// Command names and aliases that are turned off
+	Disabled []string
+
+	// Guild defined aliases, mapping a name to the command line it runs
+	Aliases map[string]string
+
+	// Roles a member needs one of to use the bot, everyone may if empty
+	OnlyRoles []string
+
+	// Roles that may play into voice channels their members aren't in,
+	// besides members with the Move Members permission
+	TargetRoles []string
+
+	// Rules for what members of each role may do, by role ID
+	Roles map[string]*RoleRule
+
+	// Rate limit tier for members no role gives a better one
+	RateLimit string
+
+	// Daily quiet hours in the guild's timezone, what happens to plays during
+	// them and the roles that may still play sounds in the role mode
+	QuietHours []quietWindow
+	QuietMode  string
+	QuietRoles []string
+	Location   *time.Location
+
+	// Settings the guild changed from their default, as stored
+	values   map[string]string
+	loadedAt time.Time
+}
+
+// setting describes one configurable value of GuildSettings
+type setting struct {
+	Name  string
+	Usage string
+	Help  string
+
+	// If set, parse is given the value as typed instead of lowercased
+	raw bool
+
+	// Parses a value given to config set into the form it is stored in
+	parse func(guild *discordgo.Guild, args []string) (string, error)
+
+	// Applies a stored value to settings
+	apply func(s *GuildSettings, value string)
+
+	// Formats the current value for config get
+	format func(s *GuildSettings) string
+}
+
+var SETTINGS = []*setting{
+	{
+		Name:  "collections",
+		Usage: "<collection...>|all",
+		Help:  "Sound collections that may be played",
+		parse: parseCollectionsSetting,
+		apply: func(s *GuildSettings, value string) {
+			s.Collections = splitList(value)
+		},
+		format: func(s *GuildSettings) string {
+			if len(s.Collections) == 0 {
+				return "all"
+			}
+
+			// Show collections by the command that plays them
+			names := make([]string, 0, len(s.Collections))
+			for _, prefix := range s.Collections {
+				names = append(names, collectionName(prefix))
+			}
+			return strings.Join(names, ", ")
+		},
+	},
+	{
+		Name:  "prefix",
+		Usage: "<prefix...>|mention",
+		Help:  "What commands start with, mention only accepts commands that mention the bot",
+		parse: parsePrefixSetting,
+		apply: func(s *GuildSettings, value string) {
+			if value == "mention" {
+				s.Prefixes = nil
+			} else {
+				s.Prefixes = splitList(value)
+			}
+		},
+		format: func(s *GuildSettings) string {
+			if len(s.Prefixes) == 0 {
+				return "mention"
+			}
+			return strings.Join(s.Prefixes, " ")
+		},
+	},
+	channelListSetting("channels", "Text channels commands are accepted in, admins can use any", false, "all",
+		func(s *GuildSettings) *[]string { return &s.TextChannels }),
+	channelListSetting("blocked_channels", "Text channels commands are ignored in, admins can use any", false, "none",
+		func(s *GuildSettings) *[]string { return &s.BlockedTextChannels }),
+	channelListSetting("voice_channels", "Voice channels sounds may be played in", true, "all",
+		func(s *GuildSettings) *[]string { return &s.VoiceChannels }),
+	channelListSetting("blocked_voice_channels", "Voice channels sounds are never played in", true, "none",
+		func(s *GuildSettings) *[]string { return &s.BlockedVoiceChannels }),
+	{
+		Name:  "blocked_message",
+		Usage: "<message>|none",
+		Help:  "Reply to commands blocked by the channel or only_roles settings, they're ignored if none",
+		raw:   true,
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			message := strings.Join(args, " ")
+			if strings.ToLower(message) == "none" {
+				return "", nil
+			}
+
+			if len(message) > 200 {
+				return "", fmt.Errorf("the message must be up to 200 characters")
+			}
+			return message, nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			s.BlockedMessage = value
+		},
+		format: func(s *GuildSettings) string {
+			if s.BlockedMessage == "" {
+				return "none"
+			}
+			return s.BlockedMessage
+		},
+	},
+	{
+		Name:  "disabled",
+		Usage: "<command...>|none",
+		Help:  "Command names and aliases to ignore",
+		parse: parseDisabledSetting,
+		apply: func(s *GuildSettings, value string) {
+			s.Disabled = splitList(value)
+		},
+		format: func(s *GuildSettings) string {
+			if len(s.Disabled) == 0 {
+				return "none"
+			}
+			return strings.Join(s.Disabled, ", ")
+		},
+	},
+	roleListSetting("only_roles", "Roles a member needs one of to use the bot, admins always can", "everyone",
+		func(s *GuildSettings) *[]string { return &s.OnlyRoles }),
+	roleListSetting("target_roles", "Roles that may play into voice channels they aren't in, as can members with Move Members", "none",
+		func(s *GuildSettings) *[]string { return &s.TargetRoles }),
+	{
+		Name:  "rate_limit",
+		Usage: "unlimited|fast|normal|slow",
+		Help:  "How often members may play sounds, roles can be given a better tier",
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			value := strings.Join(args, "")
+			if _, ok := findRateTier(value); !ok {
+				return "", fmt.Errorf("tiers are %s", strings.Join(rateTierNames(), ", "))
+			}
+			return value, nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			if _, ok := findRateTier(value); ok {
+				s.RateLimit = value
+			}
+		},
+		format: func(s *GuildSettings) string {
+			return s.RateLimit
+		},
+	},
+	{
+		Name:  "timezone",
+		Usage: "<IANA timezone>",
+		Help:  "Timezone quiet hours are in, e.g. Europe/Berlin",
+		raw:   true,
+		parse: parseTimezoneSetting,
+		apply: func(s *GuildSettings, value string) {
+			if loc, err := time.LoadLocation(value); err == nil {
+				s.Location = loc
+			}
+		},
+		format: func(s *GuildSettings) string {
+			return s.Location.String()
+		},
+	},
+	{
+		Name:  "quiet_hours",
+		Usage: "<HH:MM-HH:MM, ...>|none",
+		Help:  "Daily windows when sounds are held back",
+		parse: parseQuietHoursSetting,
+		apply: func(s *GuildSettings, value string) {
+			s.QuietHours = nil
+			for _, item := range splitList(value) {
+				if w, err := parseQuietWindow(item); err == nil {
+					s.QuietHours = append(s.QuietHours, w)
+				}
+			}
+		},
+		format: func(s *GuildSettings) string {
+			if len(s.QuietHours) == 0 {
+				return "none"
+			}
+
+			windows := make([]string, 0, len(s.QuietHours))
+			for _, w := range s.QuietHours {
+				windows = append(windows, w.String())
+			}
+			return strings.Join(windows, ", ")
+		},
+	},
+	{
+		Name:  "quiet_mode",
+		Usage: "reject|queue|role",
+		Help:  "Whether plays in quiet hours are rejected, wait until they end, or need a quiet_roles role",
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			value := strings.Join(args, "")
+			if value != QUIET_REJECT && value != QUIET_QUEUE && value != QUIET_ROLE {
+				return "", fmt.Errorf("the mode must be %s, %s or %s", QUIET_REJECT, QUIET_QUEUE, QUIET_ROLE)
+			}
+			return value, nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			s.QuietMode = value
+		},
+		format: func(s *GuildSettings) string {
+			return s.QuietMode
+		},
+	},
+	roleListSetting("quiet_roles", "Roles that may play sounds during quiet hours in the role mode", "none",
+		func(s *GuildSettings) *[]string { return &s.QuietRoles }),
+	{
+		Name:  "queue_size",
+		Usage: "<plays>",
+		Help:  "How many plays may wait in the queue",
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			size, err := strconv.Atoi(strings.Join(args, ""))
+			if err != nil || size < 1 || size > MAX_GUILD_QUEUE_SIZE {
+				return "", fmt.Errorf("the queue size must be between 1 and %d", MAX_GUILD_QUEUE_SIZE)
+			}
+			return strconv.Itoa(size), nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			if size, err := strconv.Atoi(value); err == nil {
+				s.QueueSize = size
+			}
+		},
+		format: func(s *GuildSettings) string {
+			return strconv.Itoa(s.QueueSize)
+		},
+	},
+	{
+		Name:  "feedback",
+		Usage: "silent|text",
+		Help:  "Whether to explain why a sound couldn't be played",
+		parse: func(guild *discordgo.Guild, args []string) (string, error) {
+			value := strings.Join(args, "")
+			if value != FEEDBACK_SILENT && value != FEEDBACK_TEXT {
+				return "", fmt.Errorf("feedback must be %s or %s", FEEDBACK_SILENT, FEEDBACK_TEXT)
+			}
+			return value, nil
+		},
+		apply: func(s *GuildSettings, value string) {
+			s.Feedback = value
+		},
+		format: func(s *GuildSettings) string {
+			return s.Feedback
+		},
+	},
+}
+
+var (
+	// Cached settings by guild ID
+	settingsCache = make(map[string]*GuildSettings)
+	settingsMutex sync.Mutex
+
+	// Stored settings by guild ID, only used when we run without redis
+	localSettings = make(map[string]map[string]string)
+)
+
+var configCommand = &Command{
+	Name:  "config",
+	Usage: "get|set|reset",
+	Help:  "Shows or changes this server's settings",
+	Level: LevelAdmin,
+	Subcommands: []*Command{
+		{
+			Name:    "get",
+			Usage:   "[setting]",
+			MaxArgs: 1,
+			Help:    "Shows this server's settings",
+			Level:   LevelAdmin,
+			Run:     runConfigGet,
+		},
+		{
+			Name:    "set",
+			Usage:   "<setting> <value>",
+			MinArgs: 2,
+			MaxArgs: -1,
+			Help:    "Changes one of this server's settings",
+			Level:   LevelAdmin,
+			Run:     runConfigSet,
+		},
+		{
+			Name:    "reset",
+			Usage:   "[setting]",
+			MaxArgs: 1,
+			Help:    "Puts one or every setting back to its default",
+			Level:   LevelAdmin,
+			Run:     runConfigReset,
+		},
+	},
+}
+
+func defaultGuildSettings(guildID string) *GuildSettings {
+	return &GuildSettings{
+		GuildID:   guildID,
+		Prefixes:  []string{"!"},
+		QueueSize: MAX_QUEUE_SIZE,
+		Feedback:  FEEDBACK_SILENT,
+		Aliases:   make(map[string]string),
+		Roles:     make(map[string]*RoleRule),
+		RateLimit: "unlimited",
+		QuietMode: QUIET_REJECT,
+		Location:  time.UTC,
+		values:    make(map[string]string),
+	}
+}
+
+func findSetting(name string) *setting {
+	for _, s := range SETTINGS {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Whether a collection may be played in the guild
+func (s *GuildSettings) CollectionEnabled(coll *SoundCollection) bool {
+	return len(s.Collections) == 0 || scontains(coll.Prefix, s.Collections...)
+}
+
+// Returns the prefix to show in help and usage, the bot's mention if the guild
+// only accepts mentions
+func (s *GuildSettings) Prefix() string {
+	if len(s.Prefixes) == 0 {
+		return "@" + client.User().Username + " "
+	}
+	return s.Prefixes[0]
+}
+
+// Whether a command name or alias is turned off
+func (s *GuildSettings) IsDisabled(name string) bool {
+	return scontains(name, s.Disabled...)
+}
+
+func settingsKey(guildID string) string {
+	return fmt.Sprintf("airhorn:guild:%s:settings", guildID)
+}
+
+// Returns a guild's settings, loading them if they aren't cached. If they can't
+// be loaded the defaults are returned, without caching them.
+func guildSettings(guildID string) *GuildSettings {
+	settingsMutex.Lock()
+	settings, ok := settingsCache[guildID]
+	settingsMutex.Unlock()
+
+	if ok && time.Since(settings.loadedAt) < SETTINGS_CACHE_TTL {
+		return settings
+	}
+
+	values, err := loadSettingValues(guildID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guildID,
+			"error": err,
+		}).Warning("Failed to load guild settings, using defaults")
+		return defaultGuildSettings(guildID)
+	}
+
+	settings = defaultGuildSettings(guildID)
+	settings.loadedAt = time.Now()
+	for name, value := range values {
+		if strings.HasPrefix(name, ALIAS_FIELD_PREFIX) {
+			settings.Aliases[name[len(ALIAS_FIELD_PREFIX):]] = value
+			continue
+		}
+
+		if strings.HasPrefix(name, ROLE_FIELD_PREFIX) {
+			applyRoleRule(settings, name[len(ROLE_FIELD_PREFIX):], value)
+			continue
+		}
+
+		if s := findSetting(name); s != nil {
+			s.apply(settings, value)
+			settings.values[name] = value
+		}
+	}
+
+	settingsMutex.Lock()
+	settingsCache[guildID] = settings
+	settingsMutex.Unlock()
+	return settings
+}
+
+func loadSettingValues(guildID string) (map[string]string, error) {
+	if rcli == nil {
+		settingsMutex.Lock()
+		defer settingsMutex.Unlock()
+
+		values := make(map[string]string)
+		for name, value := range localSettings[guildID] {
+			values[name] = value
+		}
+		return values, nil
+	}
+
+	return rcli.HGetAllMap(settingsKey(guildID)).Result()
+}
+
+// Stores a setting, or deletes it if value is empty, and tells every shard to
+// forget the guild's cached settings
+func storeSetting(guildID, name, value string) error {
+	var err error
+	if rcli == nil {
+		settingsMutex.Lock()
+		if localSettings[guildID] == nil {
+			localSettings[guildID] = make(map[string]string)
+		}
+
+		if value == "" {
+			delete(localSettings[guildID], name)
+		} else {
+			localSettings[guildID][name] = value
+		}
+		settingsMutex.Unlock()
+	} else if value == "" {
+		err = rcli.HDel(settingsKey(guildID), name).Err()
+	} else {
+		err = rcli.HSet(settingsKey(guildID), name, value).Err()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	invalidateSettings(guildID)
+	if rcli != nil {
+		rcli.Publish(SETTINGS_CHANNEL, guildID)
+	}
+	return nil
+}
+
+func invalidateSettings(guildID string) {
+	settingsMutex.Lock()
+	delete(settingsCache, guildID)
+	settingsMutex.Unlock()
+}
+
+// Drops cached settings whenever another shard changes them, until we shut down
+func settingsLoop() {
+	pubsub, err := rcli.Subscribe(SETTINGS_CHANNEL)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to subscribe to settings channel")
+		return
+	}
+
+	go func() {
+		<-shutdown
+		pubsub.Close()
+	}()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to receive settings change")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		invalidateSettings(msg.Payload)
+	}
+}
+
+// Splits a stored comma separated list, an empty value is an empty list
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Splits config set arguments into a list, allowing commas or spaces between items
+func splitArgs(args []string) []string {
+	items := make([]string, 0)
+	for _, arg := range args {
+		for _, item := range strings.Split(arg, ",") {
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func parsePrefixSetting(guild *discordgo.Guild, args []string) (string, error) {
+	if len(args) == 1 && args[0] == "mention" {
+		return "mention", nil
+	}
+
+	for _, prefix := range args {
+		if len(prefix) > 5 || strings.ContainsAny(prefix, "<,") {
+			return "", fmt.Errorf("prefixes must be up to 5 characters without spaces, commas or <")
+		}
+	}
+	return strings.Join(args, ","), nil
+}
+
+func parseDisabledSetting(guild *discordgo.Guild, args []string) (string, error) {
+	items := splitArgs(args)
+	if len(items) == 1 && items[0] == "none" {
+		return "", nil
+	}
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if _, exists := commandsByName[item]; !exists {
+			return "", fmt.Errorf("there's no command named `%s`", item)
+		}
+
+		// Keep a way to change settings and find commands
+		if item == "airhorn" || item == "help" {
+			return "", fmt.Errorf("`%s` can't be turned off", item)
+		}
+
+		if !scontains(item, names...) {
+			names = append(names, item)
+		}
+	}
+	return strings.Join(names, ","), nil
+}
+
+// Finds a collection by its prefix or one of its commands
+func findCollection(name string) *SoundCollection {
+	for _, coll := range COLLECTIONS {
+		if name == coll.Prefix || scontains("!"+strings.TrimPrefix(name, "!"), coll.Commands...) {
+			return coll
+		}
+	}
+	return nil
+}
+
+// Returns the name of the command playing the collection with a prefix
+func collectionName(prefix string) string {
+	for _, coll := range COLLECTIONS {
+		if coll.Prefix == prefix {
+			return strings.TrimPrefix(coll.Commands[0], "!")
+		}
+	}
+	return prefix
+}
+
+func parseCollectionsSetting(guild *discordgo.Guild, args []string) (string, error) {
+	items := splitArgs(args)
+	if len(items) == 1 && items[0] == "all" {
+		return "", nil
+	}
+
+	prefixes := make([]string, 0, len(items))
+	for _, item := range items {
+		found := findCollection(item)
+		if found == nil {
+			return "", fmt.Errorf("there's no collection named `%s`", item)
+		}
+
+		if !scontains(found.Prefix, prefixes...) {
+			prefixes = append(prefixes, found.Prefix)
+		}
+	}
+	return strings.Join(prefixes, ","), nil
+}
+
+func runConfigGet(ctx *CommandContext) {
+	settings := ctx.Settings
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	for _, s := range SETTINGS {
+		if len(ctx.Args) == 1 && s.Name != ctx.Args[0] {
+			continue
+		}
+
+		value := s.format(settings)
+		if _, changed := settings.values[s.Name]; !changed {
+			value += " (default)"
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", s.Name, value)
+	}
+	w.Flush()
+
+	if buf.Len() == 0 {
+		ctx.Reply(fmt.Sprintf("There's no setting named `%s`", ctx.Args[0]))
+		return
+	}
+	ctx.Reply("```\n" + buf.String() + "```")
+}
+
+func runConfigSet(ctx *CommandContext) {
+	s := findSetting(ctx.Args[0])
+	if s == nil {
+		ctx.Reply(fmt.Sprintf("There's no setting named `%s`", ctx.Args[0]))
+		return
+	}
+
+	args := ctx.Args[1:]
+	if s.raw {
+		args = ctx.RawArgs()[1:]
+	}
+
+	value, err := s.parse(ctx.Guild, args)
+	if err != nil {
+		ctx.Reply(fmt.Sprintf("Usage: `%s %s %s`, %s", ctx.Invoked, s.Name, s.Usage, err))
+		return
+	}
+
+	err = storeSetting(ctx.Guild.ID, s.Name, value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   ctx.Guild.ID,
+			"setting": s.Name,
+			"error":   err,
+		}).Warning("Failed to store guild setting")
+		ctx.Reply("Failed to save that setting, try again in a bit")
+		return
+	}
+
+	ctx.Reply(fmt.Sprintf("Set %s to %s", s.Name, s.format(guildSettings(ctx.Guild.ID))))
+}
+
+func runConfigReset(ctx *CommandContext) {
+	names := make([]string, 0, len(SETTINGS))
+	if len(ctx.Args) == 1 {
+		if findSetting(ctx.Args[0]) == nil {
+			ctx.Reply(fmt.Sprintf("There's no setting named `%s`", ctx.Args[0]))
+			return
+		}
+		names = append(names, ctx.Args[0])
+	} else {
+		for _, s := range SETTINGS {
+			names = append(names, s.Name)
+		}
+	}
+
+	for _, name := range names {
+		err := storeSetting(ctx.Guild.ID, name, "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild":   ctx.Guild.ID,
+				"setting": name,
+				"error":   err,
+			}).Warning("Failed to reset guild setting")
+			ctx.Reply("Failed to reset settings, try again in a bit")
+			return
+		}
+	}
+
+	ctx.Reply(fmt.Sprintf("Reset %s to the default", strings.Join(names, ", ")))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSettingValues(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("500000000000000000")
+
+	cases := []struct {
+		setting string
+		value   string
+		format  string
+		valid   bool
+	}{
+		{"collections", "airhorn, jc", "airhorn, johncena", true},
+		{"collections", "all", "all", true},
+		{"collections", "kazoo", "", false},
+		{"queue_size", "3", "3", true},
+		{"queue_size", "0", "", false},
+		{"queue_size", "21", "", false},
+		{"feedback", "text", "text", true},
+		{"feedback", "loud", "", false},
+		{"blocked_message", "Not In Here", "Not In Here", true},
+		{"blocked_message", "none", "none", true},
+		{"blocked_message", strings.Repeat("a", 201), "", false},
+	}
+
+	for _, c := range cases {
+		s := findSetting(c.setting)
+		value, err := s.parse(guild, strings.Fields(c.value))
+		if (err == nil) != c.valid {
+			t.Errorf("%s %q: got error %v, expected valid %v", c.setting, c.value, err, c.valid)
+			continue
+		}
+
+		if !c.valid {
+			continue
+		}
+
+		// Values go through storage as parsed, and are shown formatted
+		settings := defaultGuildSettings(guild.ID)
+		s.apply(settings, value)
+		if format := s.format(settings); format != c.format {
+			t.Errorf("%s %q is shown as %q, expected %q", c.setting, c.value, format, c.format)
+		}
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("510000000000000000")
+	text := guild.Channels[0].ID
+
+	// Returns the bot's reply to a message, if any
+	reply := func(user *discordgo.User, content string) string {
+		before := len(state.fake.Messages())
+		state.fake.Send("1", user, text, content)
+		messages := state.fake.Messages()
+		if len(messages) == before {
+			return ""
+		}
+		return messages[len(messages)-1].Content
+	}
+
+	if content := reply(testAdmin, "!airhorn config set queue_size 3"); !strings.Contains(content, "Set queue_size to 3") {
+		t.Errorf("config set replied %q", content)
+	}
+
+	if size := guildSettings(guild.ID).QueueSize; size != 3 {
+		t.Errorf("Queue size is %d after setting it, expected 3", size)
+	}
+
+	if content := reply(testAdmin, "!airhorn config set queue_size many"); !strings.Contains(content, "Usage") {
+		t.Errorf("Invalid value replied %q, expected the usage", content)
+	}
+
+	if content := reply(testAdmin, "!airhorn config get queue_size"); !strings.Contains(content, "queue_size: 3\n") {
+		t.Errorf("config get replied %q", content)
+	}
+
+	// Only admins can change settings
+	reply(testUser, "!airhorn config set queue_size 5")
+	if size := guildSettings(guild.ID).QueueSize; size != 3 {
+		t.Errorf("A user changed the queue size to %d", size)
+	}
+
+	reply(testAdmin, "!airhorn config reset queue_size")
+	if size := guildSettings(guild.ID).QueueSize; size != MAX_QUEUE_SIZE {
+		t.Errorf("Queue size is %d after resetting it, expected %d", size, MAX_QUEUE_SIZE)
+	}
+
+	if content := reply(testAdmin, "!airhorn config get queue_size"); !strings.Contains(content, "(default)") {
+		t.Errorf("Reset setting is shown as %q, expected the default", content)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	// Gateway shard this process identifies as, only used if SHARD_COUNT > 0
+	SHARD_ID    int
+	SHARD_COUNT int
+
+	// Guild ID digits to filter by when running in the legacy sharding mode
+	LEGACY_SHARDS []string
+)
+
+// Parses the -s flag, either a gateway shard as ID/COUNT (e.g. 3/16), lease/COUNT
+// to claim any free shard through redis or, for compatibility, a comma
+// separated list of guild ID digits to filter by
+func parseShardFlag(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if !strings.Contains(value, "/") {
+		digits := strings.Split(value, ",")
+		for _, digit := range digits {
+			if len(digit) != 1 || digit[0] < '0' || digit[0] > '9' {
+				return fmt.Errorf("invalid shard digit %q", digit)
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"shards": value,
+		}).Warning("Using legacy guild ID digit sharding, pass -s ID/COUNT to use gateway sharding")
+		LEGACY_SHARDS = digits
+		return nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 1 {
+		return fmt.Errorf("invalid shard count %q", parts[1])
+	}
+
+	// The shard ID is decided once we hold a lease
+	if parts[0] == "lease" {
+		SHARD_LEASE = true
+		SHARD_COUNT = count
+		return nil
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid shard id %q", parts[0])
+	}
+
+	if id < 0 || id >= count {
+		return fmt.Errorf("shard id %d is out of range for %d shards", id, count)
+	}
+
+	SHARD_ID = id
+	SHARD_COUNT = count
+	return nil
+}
+
+// Returns the gateway shard a guild belongs to out of count shards
+func guildShard(guildID string, count int) int {
+	id, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return int((id >> 22) % uint64(count))
+}
+
+// Whether a guild id is in this shard
+func shardContains(guildid string) bool {
+	if SHARD_COUNT > 0 {
+		return guildShard(guildid, SHARD_COUNT) == SHARD_ID
+	}
+
+	if len(LEGACY_SHARDS) != 0 {
+		ok := false
+		for _, shard := range LEGACY_SHARDS {
+			if len(guildid) >= 5 && string(guildid[len(guildid)-5]) == shard {
+				ok = true
+				break
+			}
+		}
+		return ok
+	}
+	return true
+}
+
+// Describes this process's shard for status output
+func shardDescription() string {
+	if SHARD_COUNT > 0 {
+		return fmt.Sprintf("%d/%d", SHARD_ID, SHARD_COUNT)
+	}
+
+	if len(LEGACY_SHARDS) != 0 {
+		return "legacy " + strings.Join(LEGACY_SHARDS, ",")
+	}
+	return "none"
+}
+
+// Asks the gateway how many shards it recommends for this bot
+func gatewayRecommendedShards(s *discordgo.Session) (int, error) {
+	body, err := s.Request("GET", discordgo.EndpointGateway+"/bot", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Shards int `json:"shards"`
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Shards, nil
+}
+
+// Makes sure our shard count matches what the gateway recommends, the legacy
+// digit mode is skipped since every process connects unsharded
+func checkShardCount(s *discordgo.Session) error {
+	if len(LEGACY_SHARDS) != 0 {
+		return nil
+	}
+
+	recommended, err := gatewayRecommendedShards(s)
+	if err != nil {
+		return err
+	}
+
+	count := SHARD_COUNT
+	if count == 0 {
+		count = 1
+	}
+
+	if recommended != count {
+		return fmt.Errorf("gateway recommends %d shards, running with %d", recommended, count)
+	}
+	return nil
+}
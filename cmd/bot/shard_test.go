@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseShardFlag(t *testing.T) {
+	defer func(id, count int, lease bool, legacy []string) {
+		SHARD_ID, SHARD_COUNT, SHARD_LEASE, LEGACY_SHARDS = id, count, lease, legacy
+	}(SHARD_ID, SHARD_COUNT, SHARD_LEASE, LEGACY_SHARDS)
+
+	cases := []struct {
+		value string
+		id    int
+		count int
+		lease bool
+		valid bool
+	}{
+		{"3/16", 3, 16, false, true},
+		{"0/1", 0, 1, false, true},
+		{"16/16", 0, 0, false, false},
+		{"-1/16", 0, 0, false, false},
+		{"1/0", 0, 0, false, false},
+		{"a/16", 0, 0, false, false},
+	}
+
+	for _, c := range cases {
+		SHARD_ID, SHARD_COUNT, SHARD_LEASE = 0, 0, false
+
+		err := parseShardFlag(c.value)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: got error %v, expected valid %v", c.value, err, c.valid)
+			continue
+		}
+
+		if c.valid && (SHARD_ID != c.id || SHARD_COUNT != c.count || SHARD_LEASE != c.lease) {
+			t.Errorf("%q parsed as %d/%d (lease %v), expected %d/%d (lease %v)",
+				c.value, SHARD_ID, SHARD_COUNT, SHARD_LEASE, c.id, c.count, c.lease)
+		}
+	}
+
+	// Legacy digit sharding
+	LEGACY_SHARDS = nil
+	if err := parseShardFlag("1,2"); err != nil || len(LEGACY_SHARDS) != 2 {
+		t.Errorf("Legacy shards parsed as %v (%v)", LEGACY_SHARDS, err)
+	}
+
+	if err := parseShardFlag("1,23"); err == nil {
+		t.Errorf("Accepted a legacy shard that isn't a digit")
+	}
+}
+
+func TestGuildShard(t *testing.T) {
+	cases := []struct {
+		guildID uint64
+		count   int
+		shard   int
+	}{
+		{0, 16, 0},
+		{5 << 22, 16, 5},
+		{21<<22 | 1<<21, 16, 5},
+		{41771983423143937, 1, 0},
+		{41771983423143937, 10, 4},
+	}
+
+	for _, c := range cases {
+		id := strconv.FormatUint(c.guildID, 10)
+		if shard := guildShard(id, c.count); shard != c.shard {
+			t.Errorf("Guild %s is in shard %d of %d, expected %d", id, shard, c.count, c.shard)
+		}
+	}
+
+	if shard := guildShard("not a guild", 16); shard != -1 {
+		t.Errorf("Invalid guild ID is in shard %d, expected -1", shard)
+	}
+}
+
+func TestPlayShardRouting(t *testing.T) {
+	state := setupTestBot(t)
+
+	// Guild IDs carry their shard in their timestamp bits
+	ours := state.addGuild(strconv.FormatUint(1<<22, 10))
+	theirs := state.addGuild(strconv.FormatUint(2<<22, 10))
+
+	oldID, oldCount := SHARD_ID, SHARD_COUNT
+	SHARD_ID, SHARD_COUNT = 1, 2
+	defer func() {
+		SHARD_ID, SHARD_COUNT = oldID, oldCount
+	}()
+
+	state.fake.Send("1", testUser, ours.Channels[0].ID, "!airhorn")
+	state.fake.Send("2", testUser, theirs.Channels[0].ID, "!airhorn")
+	waitForPlays(t)
+
+	if len(state.guildSinks(ours.ID)) != 1 {
+		t.Errorf("Play in our shard wasn't played")
+	}
+
+	if len(state.guildSinks(theirs.ID)) != 0 {
+		t.Errorf("Play in another shard was played")
+	}
+}
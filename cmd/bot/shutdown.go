@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// Closed once the bot starts shutting down, no new commands are accepted after this
+	shutdown = make(chan struct{})
+
+	// Closed once the shutdown deadline has passed and in-flight plays should be cut off
+	shutdownExpired = make(chan struct{})
+
+	// Tracks enqueued plays and running guild play loops
+	playsWG sync.WaitGroup
+
+	// Held while adding to playsWG and while starting the shutdown, so no
+	// play is added once we've started waiting for them
+	playsMutex sync.Mutex
+
+	// Tracks pending stats writes
+	statsWG sync.WaitGroup
+)
+
+// Whether the bot has started shutting down
+func isShuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Whether the shutdown deadline has passed
+func isShutdownExpired() bool {
+	select {
+	case <-shutdownExpired:
+		return true
+	default:
+		return false
+	}
+}
+
+// Runs fn in a goroutine tracked by playsWG, returns false without running it
+// if the bot has started shutting down
+func trackPlay(fn func()) bool {
+	playsMutex.Lock()
+	defer playsMutex.Unlock()
+
+	if isShuttingDown() {
+		return false
+	}
+
+	playsWG.Add(1)
+	go func() {
+		defer playsWG.Done()
+		fn()
+	}()
+	return true
+}
+
+// Waits for a WaitGroup, returning false if the timeout passed first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Logs every play still waiting in a guild queue or for quiet hours to end
+func reportQueuedPlays() {
+	dropDeferredPlays()
+
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+
+	for guildID, queue := range queues {
+		for play := queue.Pop(); play != nil; play = queue.Pop() {
+			playsDropped.WithLabelValues(DROP_SHUTDOWN).Inc()
+			log.WithFields(log.Fields{
+				"guild":    guildID,
+				"channel":  play.ChannelID,
+				"user":     play.UserID,
+				"sound":    play.Sound.Name,
+				"priority": play.Priority,
+			}).Warning("Dropping queued play on shutdown")
+		}
+	}
+}
+
+// Disconnects every open voice sink
+func disconnectVoice() {
+	sinksMutex.Lock()
+	open := make(map[string]VoiceSink, len(sinks))
+	for guildID, sink := range sinks {
+		open[guildID] = sink
+	}
+	sinksMutex.Unlock()
+
+	for guildID, sink := range open {
+		closeVoiceSink(guildID, sink)
+	}
+}
+
+// Stops accepting commands, lets current plays finish (up to timeout), then
+// disconnects from voice, flushes stats and closes the discord session
+func gracefulShutdown(timeout time.Duration) {
+	log.WithFields(log.Fields{
+		"timeout": timeout,
+	}).Info("Shutting down, waiting for plays to finish")
+	playsMutex.Lock()
+	close(shutdown)
+	playsMutex.Unlock()
+
+	// Plays waiting for quiet hours won't get to play before we exit
+	dropDeferredPlays()
+
+	if !waitTimeout(&playsWG, timeout) {
+		log.Warning("Timed out waiting for plays to finish")
+		close(shutdownExpired)
+		reportQueuedPlays()
+	}
+	disconnectVoice()
+
+	if !waitTimeout(&statsWG, timeout) {
+		log.Warning("Timed out waiting for stats to flush")
+	}
+
+	statsStore.Close()
+
+	if rcli != nil {
+		releaseShardLease()
+		rcli.Close()
+	}
+
+	err := client.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to close discord session")
+	}
+
+	log.Info("Shutdown complete")
+}
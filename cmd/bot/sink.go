@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	// Returned by a sink when a send is cut off by the shutdown deadline
+	errShutdownExpired = errors.New("shutdown deadline passed")
+
+	// Returned by a sink that was already disconnected
+	errSinkClosed = errors.New("voice sink is closed")
+
+	// Creates the sink used for new guild voice sessions
+	newVoiceSink func(guildID string) VoiceSink = newDiscordSink
+
+	// Map of Guild id's to their open voice sinks
+	sinks      map[string]VoiceSink = make(map[string]VoiceSink)
+	sinksMutex sync.Mutex
+)
+
+// VoiceSink is the destination a guild's plays are sent to
+type VoiceSink interface {
+	// Join connects to a voice channel, or moves there if already connected
+	Join(channelID string) error
+
+	// ChannelID returns the channel currently joined, or an empty string
+	ChannelID() string
+
+	// Speaking marks the start and end of a sound
+	Speaking(speaking bool) error
+
+	// Send writes a single 20ms Opus frame
+	Send(opus []byte) error
+
+	// Disconnect leaves the voice channel and releases the sink, it is safe to call more than once
+	Disconnect() error
+}
+
+// Opens a new voice sink for a guild and tracks it until it is closed
+func openVoiceSink(guildID string) VoiceSink {
+	sink := newVoiceSink(guildID)
+
+	sinksMutex.Lock()
+	sinks[guildID] = sink
+	sinksMutex.Unlock()
+	return sink
+}
+
+// Disconnects a guild's voice sink and stops tracking it
+func closeVoiceSink(guildID string, sink VoiceSink) error {
+	sinksMutex.Lock()
+	if sinks[guildID] == sink {
+		delete(sinks, guildID)
+	}
+	sinksMutex.Unlock()
+
+	return sink.Disconnect()
+}
+
+// discordSink sends plays to a discord voice connection
+type discordSink struct {
+	sync.Mutex
+
+	guildID string
+	vc      *discordgo.VoiceConnection
+}
+
+func newDiscordSink(guildID string) VoiceSink {
+	return &discordSink{guildID: guildID}
+}
+
+// Returns the voice connection, nil once the sink is disconnected
+func (d *discordSink) conn() *discordgo.VoiceConnection {
+	d.Lock()
+	defer d.Unlock()
+	return d.vc
+}
+
+func (d *discordSink) Join(channelID string) (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.vc == nil {
+		d.vc, err = discord.ChannelVoiceJoin(d.guildID, channelID, false, false)
+		if err != nil {
+			d.vc = nil
+		}
+		return err
+	}
+
+	err = d.vc.ChangeChannel(channelID, false, false)
+	time.Sleep(time.Millisecond * 125)
+	return err
+}
+
+func (d *discordSink) ChannelID() string {
+	vc := d.conn()
+	if vc == nil {
+		return ""
+	}
+	return vc.ChannelID
+}
+
+func (d *discordSink) Speaking(speaking bool) error {
+	vc := d.conn()
+	if vc == nil {
+		return errSinkClosed
+	}
+	return vc.Speaking(speaking)
+}
+
+func (d *discordSink) Send(opus []byte) error {
+	vc := d.conn()
+	if vc == nil {
+		return errSinkClosed
+	}
+
+	select {
+	case vc.OpusSend <- opus:
+		return nil
+	case <-shutdownExpired:
+		return errShutdownExpired
+	}
+}
+
+func (d *discordSink) Disconnect() error {
+	d.Lock()
+	vc := d.vc
+	d.vc = nil
+	d.Unlock()
+
+	if vc == nil {
+		return nil
+	}
+	return vc.Disconnect()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/layeh/gopus"
+)
+
+var (
+	errSinkNotJoined = errors.New("sink has not joined a channel")
+
+	// Number of files written per guild, used to name each voice session's file
+	fileSinkCounts      map[string]int = make(map[string]int)
+	fileSinkCountsMutex sync.Mutex
+)
+
+// packetWriter writes Opus packets to an audio file
+type packetWriter interface {
+	WritePacket(opus []byte) error
+	Close() error
+}
+
+// fileSink writes each of a guild's voice sessions to a file instead of discord,
+// named <guild>-<n>.<format> where n counts the guild's sessions from 1
+type fileSink struct {
+	sync.Mutex
+
+	dir       string
+	format    string
+	guildID   string
+	channelID string
+
+	file   *os.File
+	writer packetWriter
+}
+
+// Returns a constructor for file sinks writing to dir in the given format (ogg or wav)
+func fileSinkFactory(dir, format string) (func(guildID string) VoiceSink, error) {
+	if format != "ogg" && format != "wav" {
+		return nil, fmt.Errorf("unknown sink format %q", format)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return func(guildID string) VoiceSink {
+		return &fileSink{dir: dir, format: format, guildID: guildID}
+	}, nil
+}
+
+func (f *fileSink) Join(channelID string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.channelID = channelID
+	if f.file != nil {
+		return nil
+	}
+
+	fileSinkCountsMutex.Lock()
+	fileSinkCounts[f.guildID]++
+	n := fileSinkCounts[f.guildID]
+	fileSinkCountsMutex.Unlock()
+
+	path := filepath.Join(f.dir, fmt.Sprintf("%s-%d.%s", f.guildID, n, f.format))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var writer packetWriter
+	if f.format == "wav" {
+		writer, err = newWavWriter(file)
+	} else {
+		writer, err = newOggOpusWriter(file, crc32.ChecksumIEEE([]byte(path)), 2)
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   f.guildID,
+		"channel": channelID,
+		"path":    path,
+	}).Info("Writing voice session to file")
+
+	f.file = file
+	f.writer = writer
+	return nil
+}
+
+func (f *fileSink) ChannelID() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.channelID
+}
+
+func (f *fileSink) Speaking(speaking bool) error {
+	return nil
+}
+
+func (f *fileSink) Send(opus []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.writer == nil {
+		return errSinkNotJoined
+	}
+	return f.writer.WritePacket(opus)
+}
+
+func (f *fileSink) Disconnect() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.writer.Close()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+
+	f.file = nil
+	f.writer = nil
+	f.channelID = ""
+	return err
+}
+
+// wavWriter decodes Opus packets and writes them as 16-bit 48kHz stereo PCM
+type wavWriter struct {
+	w        io.WriteSeeker
+	decoder  *gopus.Decoder
+	dataSize uint32
+}
+
+func newWavWriter(w io.WriteSeeker) (*wavWriter, error) {
+	decoder, err := gopus.NewDecoder(48000, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ww := &wavWriter{w: w, decoder: decoder}
+	return ww, ww.writeHeader()
+}
+
+func (ww *wavWriter) writeHeader() error {
+	header := []interface{}{
+		[]byte("RIFF"),
+		uint32(36 + ww.dataSize),
+		[]byte("WAVE"),
+		[]byte("fmt "),
+		uint32(16),
+		uint16(1),
+		uint16(2),
+		uint32(48000),
+		uint32(48000 * 2 * 2),
+		uint16(2 * 2),
+		uint16(16),
+		[]byte("data"),
+		ww.dataSize,
+	}
+
+	for _, field := range header {
+		if err := binary.Write(ww.w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ww *wavWriter) WritePacket(opus []byte) error {
+	pcm, err := ww.decoder.Decode(opus, opusFrameSize, false)
+	if err != nil {
+		return err
+	}
+
+	ww.dataSize += uint32(len(pcm) * 2)
+	return binary.Write(ww.w, binary.LittleEndian, pcm)
+}
+
+// Close rewrites the header now that the data size is known
+func (ww *wavWriter) Close() error {
+	if _, err := ww.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return ww.writeHeader()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// oggPage is a page read back from an Ogg file
+type oggPage struct {
+	HeaderType byte
+	Granule    uint64
+	Payload    []byte
+}
+
+// Reads every page of an Ogg file, checking their checksums
+func readOggPages(t *testing.T, path string) []oggPage {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := make([]oggPage, 0)
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			t.Fatalf("%s: bad page header after %d pages", path, len(pages))
+		}
+
+		segments := int(data[26])
+		size := 27 + segments
+		payload := 0
+		for _, lacing := range data[27 : 27+segments] {
+			payload += int(lacing)
+		}
+		size += payload
+
+		page := append([]byte{}, data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		copy(page[22:26], []byte{0, 0, 0, 0})
+		if oggCRC(page) != crc {
+			t.Fatalf("%s: page %d has a bad checksum", path, len(pages))
+		}
+
+		pages = append(pages, oggPage{
+			HeaderType: data[5],
+			Granule:    binary.LittleEndian.Uint64(data[6:14]),
+			Payload:    data[27+segments : size],
+		})
+		data = data[size:]
+	}
+	return pages
+}
+
+// Replaces a sound's frames for the length of a test
+func setTestFrames(t *testing.T, sound *Sound, frames [][]byte) {
+	old := sound.buffer
+	sound.buffer = frames
+	t.Cleanup(func() {
+		sound.buffer = old
+	})
+}
+
+func TestFileSinkRender(t *testing.T) {
+	state := setupTestBot(t)
+	guild := state.addGuild("440000000000000000")
+	text := guild.Channels[0].ID
+
+	dir, err := ioutil.TempDir("", "airhorn-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newVoiceSink, err = fileSinkFactory(dir, "ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo, spam := AIRHORN.Sounds[6], AIRHORN.Sounds[2]
+	if echo.Name != "echo" || spam.Name != "spam" {
+		t.Fatalf("Expected echo and spam, got %s and %s", echo.Name, spam.Name)
+	}
+
+	setTestFrames(t, echo, [][]byte{[]byte("echo 1"), []byte("echo 2"), []byte("echo 3")})
+	setTestFrames(t, spam, [][]byte{bytes.Repeat([]byte("s"), 300)})
+
+	// Each command gets its own voice session, and so its own file
+	state.fake.Send("1", testUser, text, "!airhorn echo")
+	waitForPlays(t)
+	state.fake.Send("2", testUser, text, "!airhorn spam")
+	waitForPlays(t)
+
+	expected := [][]string{
+		{"echo 1", "echo 2", "echo 3"},
+		{string(bytes.Repeat([]byte("s"), 300))},
+	}
+
+	for i, frames := range expected {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.ogg", guild.ID, i+1))
+		pages := readOggPages(t, path)
+
+		if len(pages) != len(frames)+2 || !bytes.HasPrefix(pages[0].Payload, []byte("OpusHead")) ||
+			!bytes.HasPrefix(pages[1].Payload, []byte("OpusTags")) {
+			t.Fatalf("%s has %d pages, expected the Opus headers and %d frames", path, len(pages), len(frames))
+		}
+
+		for j, frame := range frames {
+			page := pages[j+2]
+			if string(page.Payload) != frame {
+				t.Errorf("%s: frame %d is %q, expected %q", path, j, page.Payload, frame)
+			}
+
+			if granule := uint64(opusPreSkip + (j+1)*opusFrameSize); page.Granule != granule {
+				t.Errorf("%s: frame %d ends at granule %d, expected %d", path, j, page.Granule, granule)
+			}
+		}
+
+		if last := pages[len(pages)-1]; last.HeaderType&oggHeaderEOS == 0 {
+			t.Errorf("%s: last page isn't marked as the end of the stream", path)
+		}
+	}
+}
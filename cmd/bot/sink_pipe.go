@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/layeh/gopus"
+)
+
+// Default command used by the pipe sink, reads s16le 48kHz stereo PCM from stdin
+const DEFAULT_PIPE_COMMAND = "ffplay -nodisp -autoexit -loglevel error -f s16le -ar 48000 -ac 2 -"
+
+// pipeSink decodes plays to PCM and writes them to the stdin of a local audio
+// player, one player process per voice session
+type pipeSink struct {
+	sync.Mutex
+
+	command   []string
+	guildID   string
+	channelID string
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	decoder *gopus.Decoder
+}
+
+// Returns a constructor for pipe sinks that start the given command
+func pipeSinkFactory(command string) (func(guildID string) VoiceSink, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty pipe command")
+	}
+
+	return func(guildID string) VoiceSink {
+		return &pipeSink{command: args, guildID: guildID}
+	}, nil
+}
+
+func (p *pipeSink) Join(channelID string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.channelID = channelID
+	if p.cmd != nil {
+		return nil
+	}
+
+	decoder, err := gopus.NewDecoder(48000, 2)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   p.guildID,
+		"channel": channelID,
+		"command": strings.Join(p.command, " "),
+	}).Info("Piping voice session to local player")
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.decoder = decoder
+	return nil
+}
+
+func (p *pipeSink) ChannelID() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.channelID
+}
+
+func (p *pipeSink) Speaking(speaking bool) error {
+	return nil
+}
+
+func (p *pipeSink) Send(opus []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.cmd == nil {
+		return errSinkNotJoined
+	}
+
+	pcm, err := p.decoder.Decode(opus, opusFrameSize, false)
+	if err != nil {
+		return err
+	}
+	return binary.Write(p.stdin, binary.LittleEndian, pcm)
+}
+
+func (p *pipeSink) Disconnect() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.cmd == nil {
+		return nil
+	}
+
+	p.stdin.Close()
+	err := p.cmd.Wait()
+
+	p.cmd = nil
+	p.stdin = nil
+	p.channelID = ""
+	return err
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Environment variable telling shard workers where their supervisor listens
+	SUPERVISOR_ENV = "AIRHORN_SUPERVISOR"
+
+	// Gateway limit on how often a bot may identify
+	IDENTIFY_INTERVAL = 5 * time.Second
+
+	// How often workers report their health to the supervisor
+	HEALTH_INTERVAL = 15 * time.Second
+
+	// Restart backoff for crashed workers, reset once a worker stays up for MAX_BACKOFF
+	MIN_BACKOFF = time.Second
+	MAX_BACKOFF = time.Minute
+)
+
+// Address of our supervisor, if we are running as a shard worker
+var supervisorAddr = os.Getenv(SUPERVISOR_ENV)
+
+// shardHealth is reported by each worker to the supervisor
+type shardHealth struct {
+	Shard      int       `json:"shard"`
+	Name       string    `json:"name"`
+	PID        int       `json:"pid"`
+	Guilds     int       `json:"guilds"`
+	Users      int       `json:"users"`
+	Voice      int       `json:"voice"`
+	Queues     int       `json:"queues"`
+	Queued     int       `json:"queued"`
+	Goroutines int       `json:"goroutines"`
+	Memory     uint64    `json:"memory"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// shardWorker is a shard process run by the supervisor
+type shardWorker struct {
+	Shard     int          `json:"shard"`
+	State     string       `json:"state"`
+	PID       int          `json:"pid"`
+	Restarts  int          `json:"restarts"`
+	StartedAt time.Time    `json:"started_at"`
+	LastError string       `json:"last_error,omitempty"`
+	Health    *shardHealth `json:"health,omitempty"`
+
+	cmd *exec.Cmd
+}
+
+// supervisor spawns one worker process per shard and keeps them running
+type supervisor struct {
+	sync.Mutex
+
+	count   int
+	args    []string
+	workers []*shardWorker
+
+	// Receives a token every IDENTIFY_INTERVAL, workers take one before identifying
+	identify chan struct{}
+	stopping chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Resolves the -supervise flag to a shard count, auto asks the gateway
+func superviseCount(value, token string) (int, error) {
+	if value != "auto" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return 0, fmt.Errorf("invalid shard count %q", value)
+		}
+		return count, nil
+	}
+
+	s, err := discordgo.New(token)
+	if err != nil {
+		return 0, err
+	}
+	return gatewayRecommendedShards(s)
+}
+
+// Returns the arguments every worker is started with, which are the flags we
+// were given minus the ones only the supervisor uses
+func workerArgs() []string {
+	args := make([]string, 0)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "supervise" && f.Name != "s" {
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	return args
+}
+
+// Runs count shard workers until we receive a signal to quit
+func runSupervisor(count int, shutdownTimeout time.Duration) error {
+	sup := &supervisor{
+		count:    count,
+		args:     workerArgs(),
+		identify: make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identify", sup.handleIdentify)
+	mux.HandleFunc("/health", sup.handleHealth)
+	mux.HandleFunc("/status", sup.handleStatus)
+	go http.Serve(listener, mux)
+
+	go sup.identifyLoop()
+
+	log.WithFields(log.Fields{
+		"shards": count,
+		"addr":   listener.Addr().String(),
+	}).Info("Supervising shard workers")
+
+	for i := 0; i < count; i++ {
+		worker := &shardWorker{Shard: i, State: "starting"}
+		sup.workers = append(sup.workers, worker)
+
+		sup.wg.Add(1)
+		go sup.run(worker, listener.Addr().String())
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	sup.stop(shutdownTimeout)
+	return nil
+}
+
+// Hands out an identify token every IDENTIFY_INTERVAL
+func (sup *supervisor) identifyLoop() {
+	for {
+		select {
+		case sup.identify <- struct{}{}:
+		case <-sup.stopping:
+			return
+		}
+
+		select {
+		case <-time.After(IDENTIFY_INTERVAL):
+		case <-sup.stopping:
+			return
+		}
+	}
+}
+
+// Keeps a worker running, restarting it with an exponential backoff whenever it exits
+func (sup *supervisor) run(worker *shardWorker, addr string) {
+	defer sup.wg.Done()
+
+	backoff := MIN_BACKOFF
+	for {
+		var started time.Time
+
+		args := append([]string{"-s", fmt.Sprintf("%d/%d", worker.Shard, sup.count)}, sup.args...)
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), SUPERVISOR_ENV+"="+addr)
+
+		stdout, _ := cmd.StdoutPipe()
+		stderr, _ := cmd.StderrPipe()
+
+		err := cmd.Start()
+		if err == nil {
+			started = time.Now()
+
+			sup.Lock()
+			worker.State = "running"
+			worker.PID = cmd.Process.Pid
+			worker.StartedAt = started
+			worker.cmd = cmd
+			sup.Unlock()
+
+			var pipes sync.WaitGroup
+			pipes.Add(2)
+			go forwardLogs(&pipes, worker.Shard, sup.count, stdout)
+			go forwardLogs(&pipes, worker.Shard, sup.count, stderr)
+			pipes.Wait()
+
+			err = cmd.Wait()
+		}
+
+		select {
+		case <-sup.stopping:
+			sup.Lock()
+			worker.State = "stopped"
+			sup.Unlock()
+			return
+		default:
+		}
+
+		sup.Lock()
+		if !started.IsZero() && time.Since(started) > MAX_BACKOFF {
+			backoff = MIN_BACKOFF
+		}
+		worker.State = "backoff"
+		worker.Restarts++
+		worker.Health = nil
+		worker.cmd = nil
+		if err != nil {
+			worker.LastError = err.Error()
+		}
+		sup.Unlock()
+
+		log.WithFields(log.Fields{
+			"shard":   worker.Shard,
+			"error":   err,
+			"backoff": backoff,
+		}).Warning("Shard worker exited, restarting")
+
+		select {
+		case <-time.After(backoff):
+		case <-sup.stopping:
+			return
+		}
+
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+// Copies a worker's output to ours, prefixing each line with its shard
+func forwardLogs(wg *sync.WaitGroup, shard, count int, r io.Reader) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Fprintf(os.Stderr, "[shard %d/%d] %s\n", shard, count, scanner.Text())
+	}
+}
+
+// Asks every worker to shut down gracefully, killing any that outlive the timeout
+func (sup *supervisor) stop(timeout time.Duration) {
+	close(sup.stopping)
+
+	sup.Lock()
+	for _, worker := range sup.workers {
+		if worker.cmd != nil {
+			worker.cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}
+	sup.Unlock()
+
+	// Give the workers their own shutdown timeout, plus a little for closing up
+	if !waitTimeout(&sup.wg, timeout+5*time.Second) {
+		log.Warning("Timed out waiting for shard workers, killing them")
+
+		sup.Lock()
+		for _, worker := range sup.workers {
+			if worker.cmd != nil {
+				worker.cmd.Process.Kill()
+			}
+		}
+		sup.Unlock()
+	}
+	log.Info("All shard workers stopped")
+}
+
+// Blocks until the worker may identify with the gateway
+func (sup *supervisor) handleIdentify(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-sup.identify:
+		w.WriteHeader(http.StatusNoContent)
+	case <-sup.stopping:
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+	}
+}
+
+func (sup *supervisor) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := &shardHealth{}
+	err := json.NewDecoder(r.Body).Decode(health)
+	if err != nil || health.Shard < 0 || health.Shard >= sup.count {
+		http.Error(w, "invalid health report", http.StatusBadRequest)
+		return
+	}
+	health.ReportedAt = time.Now()
+
+	sup.Lock()
+	sup.workers[health.Shard].Health = health
+	sup.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sup *supervisor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	sup.Lock()
+	body, err := json.Marshal(sup.workers)
+	sup.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Waits for our supervisor to allow us to identify, if we have one
+func waitForIdentify() error {
+	if supervisorAddr == "" {
+		return nil
+	}
+
+	resp, err := http.Get("http://" + supervisorAddr + "/identify")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("supervisor refused identify: %s", resp.Status)
+	}
+	return nil
+}
+
+// Returns this process's current health
+func currentHealth() *shardHealth {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+
+	guilds, users := 0, 0
+	for _, guild := range client.Guilds() {
+		if shardContains(guild.ID) {
+			guilds++
+			users += len(guild.Members)
+		}
+	}
+
+	queues, lengths := queuedPlays()
+	queued := 0
+	for _, n := range lengths {
+		queued += n
+	}
+
+	sinksMutex.Lock()
+	voice := len(sinks)
+	sinksMutex.Unlock()
+
+	return &shardHealth{
+		Shard:      SHARD_ID,
+		Name:       shardDescription(),
+		PID:        os.Getpid(),
+		Guilds:     guilds,
+		Users:      users,
+		Voice:      voice,
+		Queues:     queues,
+		Queued:     queued,
+		Goroutines: runtime.NumGoroutine(),
+		Memory:     stats.Alloc,
+	}
+}
+
+// Reports our health to the supervisor until we shut down
+func reportHealthLoop() {
+	for {
+		body, _ := json.Marshal(currentHealth())
+		resp, err := http.Post("http://"+supervisorAddr+"/health", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to report health to supervisor")
+		} else {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(HEALTH_INTERVAL):
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// Fetches the state of every worker from our supervisor
+func supervisorStatus() ([]*shardWorker, error) {
+	resp, err := http.Get("http://" + supervisorAddr + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	workers := make([]*shardWorker, 0)
+	err = json.NewDecoder(resp.Body).Decode(&workers)
+	return workers, err
+}
+
+// Formats the combined status of every worker as a table
+func formatSupervisorStatus(workers []*shardWorker) string {
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "Shard\tState\tPID\tRestarts\tUptime\tGuilds\tQueued\n")
+
+	guilds := 0
+	for _, worker := range workers {
+		uptime := "-"
+		if worker.State == "running" {
+			uptime = time.Since(worker.StartedAt).Truncate(time.Second).String()
+		}
+
+		health := "-\t-"
+		if worker.Health != nil {
+			health = fmt.Sprintf("%d\t%d", worker.Health.Guilds, worker.Health.Queued)
+			guilds += worker.Health.Guilds
+		}
+
+		fmt.Fprintf(w, "%d/%d\t%s\t%d\t%d\t%s\t%s\n",
+			worker.Shard, len(workers), worker.State, worker.PID, worker.Restarts, uptime, health)
+	}
+
+	fmt.Fprintf(w, "Total\t\t\t\t\t%d\t\n", guilds)
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	return buf.String()
+}
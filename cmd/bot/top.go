@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	"github.com/hammerandchisel/airhornbot/stats"
+)
+
+const (
+	// Entries shown by the top command
+	TOP_ENTRIES = 10
+
+	// Color of the leaderboard and stats embeds
+	EMBED_COLOR = 0xd93c3c
+)
+
+var topCommand = &Command{
+	Name:    "top",
+	Usage:   "[users|sounds] [week|all]",
+	MaxArgs: 2,
+	Help:    "Shows who played the most sounds in this server, or which sounds were played most",
+	Level:   LevelUser,
+	Run:     runTop,
+}
+
+func runTop(ctx *CommandContext) {
+	board, period := "users", stats.AllTime
+	for _, arg := range ctx.Args {
+		if p := stats.FindPeriod(arg); p != nil {
+			period = p
+		} else if arg == "users" || arg == "sounds" {
+			board = arg
+		} else {
+			ctx.Reply(fmt.Sprintf("Usage: `%s`", commandUsage(ctx.Invoked, ctx.Command)))
+			return
+		}
+	}
+
+	key := stats.GuildUsersBoard(ctx.Guild.ID)
+	if board == "sounds" {
+		key = stats.GuildSoundsBoard(ctx.Guild.ID)
+	}
+
+	entries, err := stats.Top(statsStore, period, key, TOP_ENTRIES)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":  ctx.Guild.ID,
+			"board":  key,
+			"period": period.Name,
+			"error":  err,
+		}).Warning("Failed to load leaderboard")
+		ctx.Reply("Failed to load the leaderboard, try again in a bit")
+		return
+	}
+
+	ctx.ReplyEmbed(leaderboardEmbed(ctx.Guild, board, period, entries))
+}
+
+// Builds the embed showing a guild's leaderboard
+func leaderboardEmbed(guild *discordgo.Guild, board string, period *stats.Period, entries []stats.Entry) *discordgo.MessageEmbed {
+	title := "Top horners"
+	if board == "sounds" {
+		title = "Most played sounds"
+	}
+
+	if period == stats.Week {
+		title += " this week"
+	} else {
+		title += " of all time"
+	}
+
+	lines := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		// Mentions in embeds show the name without pinging anyone
+		name := entry.ID
+		if board == "users" {
+			name = "<@" + entry.ID + ">"
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s: %s", i+1, name, humanize.Comma(entry.Count)))
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, "Nothing has been played yet")
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       title,
+		Description: strings.Join(lines, "\n"),
+		Color:       EMBED_COLOR,
+		Footer:      &discordgo.MessageEmbedFooter{Text: guild.Name},
+	}
+}
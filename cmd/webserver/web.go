@@ -10,6 +10,7 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/sessions"
+	"github.com/hammerandchisel/airhornbot/stats"
 	"golang.org/x/oauth2"
 	redis "gopkg.in/redis.v3"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -30,6 +32,9 @@ var (
 	// Redis client (for stats)
 	rcli *redis.Client
 
+	// Where the bot keeps its stats
+	statsStore stats.Store
+
 	// Oauth2 Config
 	oauthConf *oauth2.Config
 
@@ -44,8 +49,28 @@ var (
 
 	// Base URL of the discord API
 	apiBaseUrl = "https://discordapp.com/api"
+
+	// The last peak APS and when it was loaded, it only changes once a minute
+	peakAPS       float64
+	peakAPSLoaded time.Time
+
+	// Guilds logged in users are in, by their OAuth token
+	userGuilds      = make(map[string]*cachedGuilds)
+	userGuildsMutex sync.Mutex
 )
 
+// How often the peak APS is reloaded
+const PEAK_APS_REFRESH = time.Minute
+
+// How long a user's guilds are cached before asking discord again
+const USER_GUILDS_TTL = 5 * time.Minute
+
+// The guild IDs a user is in and when they were loaded
+type cachedGuilds struct {
+	IDs      []string
+	LoadedAt time.Time
+}
+
 // Represents a JSON struct of stats that are updated every second and pushed to the client
 type CountUpdate struct {
 	Total          string `json:"total"`
@@ -53,6 +78,8 @@ type CountUpdate struct {
 	UniqueGuilds   string `json:"unique_guilds"`
 	UniqueChannels string `json:"unique_channels"`
 	SecretCount    string `json:"secret_count"`
+	APS            string `json:"aps"`
+	PeakAPS        string `json:"peak_aps"`
 }
 
 func (c *CountUpdate) ToJSON() []byte {
@@ -61,43 +88,43 @@ func (c *CountUpdate) ToJSON() []byte {
 }
 
 func NewCountUpdate() *CountUpdate {
-	var (
-		totalCmd  *redis.StringCmd
-		usersCmd  *redis.IntCmd
-		guildsCmd *redis.IntCmd
-		chansCmd  *redis.IntCmd
-		secretCmd *redis.StringCmd
-	)
-
-	// Make a pipelined request to redis for all the counter values
-	errors, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
-		totalCmd = pipe.Get("airhorn:a:total")
-		usersCmd = pipe.SCard("airhorn:a:users")
-		guildsCmd = pipe.SCard("airhorn:a:guilds")
-		chansCmd = pipe.SCard("airhorn:a:channels")
-		secretCmd = pipe.Get("airhorn:a:sound:truck")
-		return nil
-	})
+	counts, err := stats.LoadCounts(statsStore)
 
 	// Generally this is not a huge deal, lets try to continue on
 	if err != nil {
 		log.WithFields(log.Fields{
-			"error":  err,
-			"errors": errors,
-		}).Warning("Failed to get a count update from redis")
+			"error": err,
+		}).Warning("Failed to get a count update")
+		counts = &stats.Counts{}
+	}
+
+	now := time.Now()
+	aps, err := stats.RollingAPS(statsStore, now)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to get the rolling APS")
 	}
 
-	secretCount := secretCmd.Val()
-	if secretCount == "" {
-		secretCount = "0"
+	if now.Sub(peakAPSLoaded) >= PEAK_APS_REFRESH {
+		peak, _, err := stats.PeakAPS(statsStore, now)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to get the peak APS")
+		} else {
+			peakAPS, peakAPSLoaded = peak, now
+		}
 	}
 
 	return &CountUpdate{
-		Total:          totalCmd.Val(),
-		UniqueUsers:    strconv.FormatInt(usersCmd.Val(), 10),
-		UniqueGuilds:   strconv.FormatInt(guildsCmd.Val(), 10),
-		UniqueChannels: strconv.FormatInt(chansCmd.Val(), 10),
-		SecretCount:    secretCmd.Val(),
+		Total:          strconv.FormatInt(counts.Total, 10),
+		UniqueUsers:    strconv.FormatInt(counts.Users, 10),
+		UniqueGuilds:   strconv.FormatInt(counts.Guilds, 10),
+		UniqueChannels: strconv.FormatInt(counts.Channels, 10),
+		SecretCount:    strconv.FormatInt(counts.Secret, 10),
+		APS:            strconv.FormatFloat(aps, 'f', 2, 64),
+		PeakAPS:        strconv.FormatFloat(peakAPS, 'f', 2, 64),
 	}
 }
 
@@ -256,6 +283,231 @@ func handleMe(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+// Returns a series of play counts as JSON. Takes the resolution (minute, hour
+// or day), the series (total, sound:<name> or guild:<id>), and either from and
+// to as unix timestamps or the number of points up to now.
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	res := stats.FindResolution(r.FormValue("resolution"))
+	if res == nil {
+		res = stats.Hour
+	}
+
+	series := r.FormValue("series")
+	if series == "" {
+		series = stats.TOTAL_SERIES
+	}
+
+	if err := stats.ValidSeries(series); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		points []stats.Point
+		err    error
+	)
+
+	if r.FormValue("from") != "" {
+		from, fromErr := strconv.ParseInt(r.FormValue("from"), 10, 64)
+		to, toErr := strconv.ParseInt(r.FormValue("to"), 10, 64)
+		if r.FormValue("to") == "" {
+			to, toErr = time.Now().Unix(), nil
+		}
+
+		if fromErr != nil || toErr != nil {
+			http.Error(w, "from and to are unix timestamps", http.StatusBadRequest)
+			return
+		}
+		points, err = stats.Query(statsStore, res, series, time.Unix(from, 0), time.Unix(to, 0))
+	} else {
+		n, convErr := strconv.Atoi(r.FormValue("points"))
+		if convErr != nil {
+			n = 24
+		}
+
+		if n < 1 || n > stats.MAX_POINTS {
+			http.Error(w, fmt.Sprintf("points must be between 1 and %d", stats.MAX_POINTS), http.StatusBadRequest)
+			return
+		}
+		points, err = stats.QueryLast(statsStore, res, series, n)
+	}
+
+	if err == stats.ErrInvalidRange || err == stats.ErrTooManyPoints {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"resolution": res.Name,
+			"series":     series,
+			"error":      err,
+		}).Error("Failed to query stats series")
+		http.Error(w, "Failed to load series", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resolution": res.Name,
+		"series":     series,
+		"points":     points,
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Returns a handler serving a leaderboard as JSON. Takes the period (week or
+// all) and the number of entries n. Boards that belong to a guild also take
+// the guild's ID.
+func handleTop(board func(r *http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := board(r)
+		if name == "" {
+			http.Error(w, "guild is required", http.StatusBadRequest)
+			return
+		}
+
+		period := stats.FindPeriod(r.FormValue("period"))
+		if period == nil {
+			period = stats.AllTime
+		}
+
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil {
+			n = 10
+		}
+
+		entries, err := stats.Top(statsStore, period, name, n)
+		if err == stats.ErrTooManyEntries {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"board":  name,
+				"period": period.Name,
+				"error":  err,
+			}).Error("Failed to query leaderboard")
+			http.Error(w, "Failed to load leaderboard", http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.Marshal(map[string]interface{}{
+			"period":  period.Name,
+			"entries": entries,
+		})
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// Returns the IDs of the guilds a logged in user is in, using their OAuth token
+func loadUserGuilds(token string) ([]string, error) {
+	now := time.Now()
+
+	userGuildsMutex.Lock()
+	cached, exists := userGuilds[token]
+	userGuildsMutex.Unlock()
+	if exists && now.Sub(cached.LoadedAt) < USER_GUILDS_TTL {
+		return cached.IDs, nil
+	}
+
+	req, err := http.NewRequest("GET", apiBaseUrl+"/users/@me/guilds", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: (20 * time.Second)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discord returned %s", resp.Status)
+	}
+
+	guilds := make([]*discordgo.Guild, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&guilds); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(guilds))
+	for _, guild := range guilds {
+		ids = append(ids, guild.ID)
+	}
+
+	userGuildsMutex.Lock()
+	for key, entry := range userGuilds {
+		if now.Sub(entry.LoadedAt) >= USER_GUILDS_TTL {
+			delete(userGuilds, key)
+		}
+	}
+	userGuilds[token] = &cachedGuilds{IDs: ids, LoadedAt: now}
+	userGuildsMutex.Unlock()
+	return ids, nil
+}
+
+// Wraps a handler so only logged in members of the guild named by the guild
+// parameter can use it
+func guildMembersOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "session")
+		token, _ := session.Values["token"].(string)
+		if token == "" {
+			http.Error(w, "You need to log in to see this", http.StatusUnauthorized)
+			return
+		}
+
+		guilds, err := loadUserGuilds(token)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to load the user's guilds")
+			http.Error(w, "Failed to retrieve your guilds", http.StatusInternalServerError)
+			return
+		}
+
+		guildID := r.FormValue("guild")
+		for _, id := range guilds {
+			if id == guildID {
+				handler(w, r)
+				return
+			}
+		}
+		http.Error(w, "You aren't in that guild", http.StatusForbidden)
+	}
+}
+
+// Returns a guild's board named by the guild parameter, empty without one
+func guildBoard(board func(guildID string) string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		guildID := r.FormValue("guild")
+		if _, err := strconv.ParseUint(guildID, 10, 64); err != nil {
+			return ""
+		}
+		return board(guildID)
+	}
+}
+
+// Returns a board that doesn't depend on the request
+func globalBoard(board string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return board
+	}
+}
+
 func server() {
 	server := http.NewServeMux()
 	server.Handle("/", http.FileServer(http.Dir("static/dist")))
@@ -263,9 +515,14 @@ func server() {
 	server.HandleFunc("/login", handleLogin)
 	server.HandleFunc("/callback", handleCallback)
 
-	// Only add this route if we have stats to push (e.g. redis connection)
+	// Only add this route if we have stats to push (e.g. a stats store)
 	if es != nil {
 		server.Handle("/events", es)
+		server.HandleFunc("/stats/series", handleSeries)
+		server.HandleFunc("/stats/top/guilds", handleTop(globalBoard(stats.GUILDS_BOARD)))
+		server.HandleFunc("/stats/top/sounds", handleTop(globalBoard(stats.SOUNDS_BOARD)))
+		server.HandleFunc("/stats/top/users", guildMembersOnly(handleTop(guildBoard(stats.GuildUsersBoard))))
+		server.HandleFunc("/stats/top/guild-sounds", handleTop(guildBoard(stats.GuildSoundsBoard)))
 	}
 
 	port := os.Getenv("PORT")
@@ -335,6 +592,7 @@ func main() {
 		ClientID     = flag.String("i", "", "OAuth2 Client ID")
 		ClientSecret = flag.String("s", "", "OAtuh2 Client Secret")
 		Redis        = flag.String("r", "", "Redis Connection String")
+		Stats        = flag.String("stats", "", "Stats store: redis, redis://<addr>, bolt://<path> or a bot's -metrics address as http://<addr> (defaults to redis with -r)")
 		err          error
 	)
 	flag.Parse()
@@ -345,6 +603,22 @@ func main() {
 			return
 		}
 
+		if *Stats == "" {
+			*Stats = "redis"
+		}
+	}
+
+	if *Stats != "" {
+		statsStore, err = stats.Open(*Stats, rcli)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"store": *Stats,
+				"error": err,
+			}).Error("Failed to open the stats store")
+			return
+		}
+		defer statsStore.Close()
+
 		// Now start the eventsource loop for client-side stat update
 		es = eventsource.New(nil, nil)
 		defer es.Close()
@@ -373,7 +647,7 @@ func main() {
 	oauthConf = &oauth2.Config{
 		ClientID:     *ClientID,
 		ClientSecret: *ClientSecret,
-		Scopes:       []string{"bot", "identify"},
+		Scopes:       []string{"bot", "identify", "guilds"},
 		Endpoint:     endpoint,
 		RedirectURL:  "https://airhornbot.com/callback",
 	}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// Returns the cookies of a session holding an OAuth token
+func sessionCookies(t *testing.T, token string) []*http.Cookie {
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	session, _ := store.Get(r, "session")
+	session.Values["token"] = token
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+func TestGuildMembersOnly(t *testing.T) {
+	discord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/@me/guilds" || r.Header.Get("Authorization") != "Bearer member" {
+			http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{"id": "400000000000000000", "name": "Test"}]`))
+	}))
+	defer discord.Close()
+
+	oldBase, oldStore := apiBaseUrl, store
+	apiBaseUrl, store = discord.URL, sessions.NewCookieStore([]byte("secret"))
+	defer func() {
+		apiBaseUrl, store = oldBase, oldStore
+	}()
+
+	handler := guildMembersOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("board"))
+	})
+
+	cases := []struct {
+		name   string
+		token  string
+		guild  string
+		status int
+	}{
+		{"logged out", "", "400000000000000000", http.StatusUnauthorized},
+		{"member", "member", "400000000000000000", http.StatusOK},
+		{"other guild", "member", "410000000000000000", http.StatusForbidden},
+		{"rejected token", "expired", "400000000000000000", http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/stats/top/users?guild="+c.guild, nil)
+		if c.token != "" {
+			for _, cookie := range sessionCookies(t, c.token) {
+				r.AddCookie(cookie)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, expected %d", c.name, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Package plays publishes every sound the bot plays to a redis stream, and
+// reads them back for tools that want individual plays rather than the
+// counters in package stats.
+package plays
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Stream the bot publishes plays to by default
+const STREAM = "airhorn:plays"
+
+var errMalformedEntry = errors.New("malformed stream entry")
+
+// Event is one sound played by the bot
+type Event struct {
+	// ID of the stream entry, set when reading
+	ID string `json:"id"`
+
+	// When the sound started playing
+	Time time.Time `json:"time"`
+
+	GuildID    string `json:"guild_id"`
+	ChannelID  string `json:"channel_id"`
+	UserID     string `json:"user_id"`
+	Collection string `json:"collection"`
+	Sound      string `json:"sound"`
+
+	// Whether the user picked the sound, rather than getting one at random
+	Forced bool `json:"forced"`
+
+	// Position of the sound in a chain like anotha, 0 for the first sound
+	Chain int `json:"chain"`
+
+	// The shard that played it, as shown by the bot's status command
+	Shard string `json:"shard"`
+
+	// How long it took from the command to the sound starting
+	Latency time.Duration `json:"latency"`
+}
+
+// Returns the event's stream fields, alternating names and values
+func (e *Event) fields() []interface{} {
+	return []interface{}{
+		"time", strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10),
+		"guild", e.GuildID,
+		"channel", e.ChannelID,
+		"user", e.UserID,
+		"collection", e.Collection,
+		"sound", e.Sound,
+		"forced", strconv.FormatBool(e.Forced),
+		"chain", strconv.Itoa(e.Chain),
+		"shard", e.Shard,
+		"latency_ms", strconv.FormatInt(int64(e.Latency/time.Millisecond), 10),
+	}
+}
+
+// Builds an event from a stream entry's fields
+func parseEvent(id string, fields map[string]string) *Event {
+	e := &Event{
+		ID:         id,
+		GuildID:    fields["guild"],
+		ChannelID:  fields["channel"],
+		UserID:     fields["user"],
+		Collection: fields["collection"],
+		Sound:      fields["sound"],
+		Shard:      fields["shard"],
+	}
+
+	if ms, err := strconv.ParseInt(fields["time"], 10, 64); err == nil {
+		e.Time = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	if ms, err := strconv.ParseInt(fields["latency_ms"], 10, 64); err == nil {
+		e.Latency = time.Duration(ms) * time.Millisecond
+	}
+
+	e.Forced, _ = strconv.ParseBool(fields["forced"])
+	e.Chain, _ = strconv.Atoi(fields["chain"])
+	return e
+}
+
+// Parses stream entries as returned by XRANGE, each an ID and its fields
+func parseEntries(reply []interface{}) ([]*Event, error) {
+	events := make([]*Event, 0, len(reply))
+	for _, item := range reply {
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			return nil, errMalformedEntry
+		}
+
+		id, ok := entry[0].(string)
+		values, ok2 := entry[1].([]interface{})
+		if !ok || !ok2 || len(values)%2 != 0 {
+			return nil, errMalformedEntry
+		}
+
+		fields := make(map[string]string, len(values)/2)
+		for i := 0; i < len(values); i += 2 {
+			name, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+			fields[name] = value
+		}
+		events = append(events, parseEvent(id, fields))
+	}
+	return events, nil
+}
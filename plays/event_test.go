@@ -0,0 +1,95 @@
+package plays
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builds a stream entry the way redis returns it
+func testEntry(id string, fields []interface{}) []interface{} {
+	return []interface{}{id, fields}
+}
+
+func TestParseEntries(t *testing.T) {
+	events := []*Event{
+		{
+			ID:         "1465560000000-0",
+			Time:       time.Unix(1465560000, 0),
+			GuildID:    "400000000000000000",
+			ChannelID:  "400000000000000002",
+			UserID:     "300000000000000003",
+			Collection: "airhorn",
+			Sound:      "echo",
+			Forced:     true,
+			Shard:      "1/2",
+			Latency:    150 * time.Millisecond,
+		},
+		{
+			ID:         "1465560000000-1",
+			Time:       time.Unix(1465560000, 0),
+			GuildID:    "400000000000000000",
+			ChannelID:  "400000000000000002",
+			UserID:     "300000000000000003",
+			Collection: "anotha",
+			Sound:      "one_more",
+			Chain:      1,
+			Shard:      "1/2",
+		},
+	}
+
+	reply := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		reply = append(reply, testEntry(e.ID, e.fields()))
+	}
+
+	parsed, err := parseEntries(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed) != len(events) {
+		t.Fatalf("Parsed %d events, expected %d", len(parsed), len(events))
+	}
+
+	for i, e := range events {
+		if !parsed[i].Time.Equal(e.Time) {
+			t.Errorf("Event %d is at %s, expected %s", i, parsed[i].Time, e.Time)
+		}
+
+		parsed[i].Time = e.Time
+		if !reflect.DeepEqual(parsed[i], e) {
+			t.Errorf("Event %d parsed as %+v, expected %+v", i, parsed[i], e)
+		}
+	}
+}
+
+func TestParseEntriesMalformed(t *testing.T) {
+	cases := map[string][]interface{}{
+		"not an entry":    {"1-0"},
+		"no fields":       {[]interface{}{"1-0"}},
+		"numeric ID":      {[]interface{}{int64(1), []interface{}{}}},
+		"odd fields":      {testEntry("1-0", []interface{}{"guild"})},
+		"fields not list": {[]interface{}{"1-0", "guild"}},
+	}
+
+	for name, reply := range cases {
+		if _, err := parseEntries(reply); err != errMalformedEntry {
+			t.Errorf("%s: got error %v, expected %v", name, err, errMalformedEntry)
+		}
+	}
+}
+
+func TestParseEventMissingFields(t *testing.T) {
+	// Older or partial entries leave the rest of the event zeroed
+	e := parseEvent("1-0", map[string]string{
+		"guild":  "400000000000000000",
+		"time":   "not a time",
+		"forced": "maybe",
+	})
+
+	expected := &Event{ID: "1-0", GuildID: "400000000000000000"}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Parsed %+v, expected %+v", e, expected)
+	}
+}
@@ -0,0 +1,51 @@
+package plays
+
+import (
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Publisher adds events to a stream, trimming it to its retention as it goes
+type Publisher struct {
+	rcli   *redis.Client
+	stream string
+
+	// Roughly how many events to keep, 0 for no limit
+	MaxLen int64
+
+	// Roughly how long to keep events for, 0 for no limit
+	MaxAge time.Duration
+}
+
+func NewPublisher(rcli *redis.Client, stream string) *Publisher {
+	return &Publisher{rcli: rcli, stream: stream}
+}
+
+// Adds an event to the stream. Trimming is approximate, so redis can drop
+// whole blocks of old entries at once.
+func (p *Publisher) Publish(e *Event) error {
+	args := []interface{}{"XADD", p.stream}
+	if p.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", p.MaxLen)
+	}
+	args = append(args, "*")
+	args = append(args, e.fields()...)
+
+	cmds := []redis.Cmder{redis.NewStringCmd(args...)}
+
+	// Entry IDs start with their time in milliseconds, so anything older
+	// than the cutoff can go
+	if p.MaxAge > 0 {
+		cutoff := TimeID(time.Now().Add(-p.MaxAge))
+		cmds = append(cmds, redis.NewIntCmd("XTRIM", p.stream, "MINID", "~", cutoff))
+	}
+
+	_, err := p.rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, cmd := range cmds {
+			pipe.Process(cmd)
+		}
+		return nil
+	})
+	return err
+}
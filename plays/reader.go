@@ -0,0 +1,129 @@
+package plays
+
+import (
+	"strconv"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Stream IDs to start reading from
+const (
+	// Every event still in the stream
+	FROM_START = "0"
+
+	// Only events published after the reader's first read
+	FROM_NOW = "$"
+)
+
+// Reader follows a stream, returning each event once. It isn't safe for
+// concurrent use.
+type Reader struct {
+	rcli   *redis.Client
+	stream string
+
+	// ID of the last event read, the next read returns events after it
+	LastID string
+}
+
+// Returns a reader following stream from an entry ID, FROM_START or FROM_NOW.
+// Resume a reader by passing the LastID of the one before it.
+func NewReader(rcli *redis.Client, stream, from string) *Reader {
+	return &Reader{rcli: rcli, stream: stream, LastID: from}
+}
+
+// Returns up to count events after the last one read, waiting up to block
+// for one to be published if there are none (0 doesn't wait). Returns no
+// events if none were published in time. block must be shorter than the
+// client's read timeout.
+func (r *Reader) Read(count int64, block time.Duration) ([]*Event, error) {
+	// "$" means the stream's newest entry at the time of each XREAD, so pin
+	// it down once or every read would skip what came in since the last
+	if r.LastID == FROM_NOW {
+		last, err := lastID(r.rcli, r.stream)
+		if err != nil {
+			return nil, err
+		}
+		r.LastID = last
+	}
+
+	args := []interface{}{"XREAD", "COUNT", count}
+	if block > 0 {
+		args = append(args, "BLOCK", int64(block/time.Millisecond))
+	}
+	args = append(args, "STREAMS", r.stream, r.LastID)
+
+	cmd := redis.NewSliceCmd(args...)
+	r.rcli.Process(cmd)
+
+	reply, err := cmd.Result()
+	if err == redis.Nil {
+		return []*Event{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// We only read one stream, its reply is its name and its entries
+	if len(reply) == 0 {
+		return []*Event{}, nil
+	}
+
+	stream, ok := reply[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, errMalformedEntry
+	}
+
+	entries, ok := stream[1].([]interface{})
+	if !ok {
+		return nil, errMalformedEntry
+	}
+
+	events, err := parseEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > 0 {
+		r.LastID = events[len(events)-1].ID
+	}
+	return events, nil
+}
+
+// Returns up to count events with IDs between start and end inclusive, "-"
+// and "+" being the oldest and newest. Times work as IDs too, see TimeID.
+func Range(rcli *redis.Client, stream, start, end string, count int64) ([]*Event, error) {
+	cmd := redis.NewSliceCmd("XRANGE", stream, start, end, "COUNT", count)
+	rcli.Process(cmd)
+
+	reply, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(reply)
+}
+
+// Returns the ID of a stream's newest entry, or FROM_START if it's empty
+func lastID(rcli *redis.Client, stream string) (string, error) {
+	cmd := redis.NewSliceCmd("XREVRANGE", stream, "+", "-", "COUNT", 1)
+	rcli.Process(cmd)
+
+	reply, err := cmd.Result()
+	if err != nil {
+		return "", err
+	}
+
+	events, err := parseEntries(reply)
+	if err != nil {
+		return "", err
+	}
+
+	if len(events) == 0 {
+		return FROM_START, nil
+	}
+	return events[0].ID, nil
+}
+
+// Returns the stream ID of the first event that could be published at t
+func TimeID(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
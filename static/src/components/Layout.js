@@ -33,6 +33,8 @@ type State = {
   uniqueGuilds: number,
   uniqueChannels: number,
   secretCount: number,
+  aps: number,
+  peakAps: number,
   showStats: boolean,
   statsHasBeenShown: boolean,
   changeCount: boolean,
@@ -70,6 +72,8 @@ const Layout = React.createClass({
       uniqueGuilds: 0,
       uniqueChannels: 0,
       secretCount: 0,
+      aps: 0,
+      peakAps: 0,
       showStats: false,
       statsHasBeenShown: false,
       changeCount: false,
@@ -118,6 +122,8 @@ const Layout = React.createClass({
       uniqueGuilds: AirhornStatsStore.getUniqueGuilds(),
       uniqueChannels: AirhornStatsStore.getUniqueChannels(),
       secretCount: AirhornStatsStore.getSecretCount(),
+      aps: AirhornStatsStore.getAPS(),
+      peakAps: AirhornStatsStore.getPeakAPS(),
       showStats: AirhornStatsStore.shouldShowStatsPanel(),
       statsHasBeenShown: this.state.statsHasBeenShown || AirhornStatsStore.shouldShowStatsPanel(),
       changeCount: this.state.count != AirhornStatsStore.getCount()
@@ -183,6 +189,8 @@ const Layout = React.createClass({
           uniqueGuilds={this.state.uniqueGuilds}
           uniqueChannels={this.state.uniqueChannels}
           secretCount={this.state.secretCount}
+          aps={this.state.aps}
+          peakAps={this.state.peakAps}
           hasBeenShown={this.state.statsHasBeenShown}
           bottom={this.state.footerHeight} />
         <Footer
@@ -7,12 +7,12 @@ import Constants from '../Constants';
 
 const BOTTOM_PADDING = 8;
 
-const StatsRow = ({icon, label, value}) => {
+const StatsRow = ({icon, label, value, format = '0,0'}) => {
   return (
     <div className="stats-row">
       <img src={icon} />
       <div className="label-value">
-        <div className="value">{numeral(value).format('0,0')}</div>
+        <div className="value">{numeral(value).format(format)}</div>
         <div className="label">{label}</div>
       </div>
     </div>
@@ -25,6 +25,8 @@ type StatsPanelProps = {
   uniqueGuilds: number,
   uniqueChannels: number,
   secretCount: number,
+  aps: number,
+  peakAps: number,
   show: boolean,
   hasBeenShown: boolean,
   bottom: number
@@ -36,6 +38,8 @@ const StatsPanel = ({
   uniqueGuilds,
   uniqueChannels,
   secretCount,
+  aps,
+  peakAps,
   show,
   hasBeenShown,
   bottom
@@ -51,6 +55,8 @@ const StatsPanel = ({
       <StatsRow icon={Constants.Image.ICON_SERVERS} label="Unique Servers" value={uniqueGuilds} />
       <StatsRow icon={Constants.Image.ICON_CHANNELS} label="Unique Channels" value={uniqueChannels} />
       <StatsRow icon={Constants.Image.ICON_SECERT} label="Secret Plays" value={secretCount} />
+      <StatsRow icon={Constants.Image.ICON_PLAYS} label="Airhorns Per Second" value={aps} format="0,0.00" />
+      <StatsRow icon={Constants.Image.ICON_PLAYS} label="Peak Per Second (24h)" value={peakAps} format="0,0.00" />
     </div>
   );
 };
@@ -7,7 +7,9 @@ type MessageEventData = {
   unique_users: number,
   unique_guilds: number,
   unique_channels: number,
-  secret_count: number
+  secret_count: number,
+  aps: number,
+  peak_aps: number
 }
 
 declare class EventSource {
@@ -10,6 +10,8 @@ let uniqueUsers = 0;
 let uniqueGuilds = 0;
 let uniqueChannels = 0;
 let secretCount = 0;
+let aps = 0;
+let peakAps = 0;
 let shouldShowStatsPanel = false;
 
 class AirhornStatsStore extends EventEmitter {
@@ -56,6 +58,8 @@ class AirhornStatsStore extends EventEmitter {
     uniqueGuilds = data.unique_guilds || 0;
     uniqueChannels = data.unique_channels || 0;
     secretCount = data.secret_count || 0;
+    aps = data.aps || 0;
+    peakAps = data.peak_aps || 0;
     this.emit('change');
   }
 
@@ -94,6 +98,14 @@ class AirhornStatsStore extends EventEmitter {
     return secretCount;
   }
 
+  getAPS(): number {
+    return aps;
+  }
+
+  getPeakAPS(): number {
+    return peakAps;
+  }
+
   shouldShowStatsPanel(): boolean {
     return shouldShowStatsPanel;
   }
@@ -0,0 +1,70 @@
+package stats
+
+import "time"
+
+const (
+	// How many whole minutes the rolling APS covers, besides the current one
+	APS_WINDOW = 5
+
+	// How far back the peak APS looks, in minutes
+	PEAK_WINDOW = MAX_POINTS
+)
+
+// Throughput is how many airhorns per second (of every play, forced or
+// random) are being played, from the per-minute total series
+type Throughput struct {
+	// Over the last APS_WINDOW minutes and the current one so far
+	APS float64 `json:"aps"`
+
+	// The busiest whole minute in the last PEAK_WINDOW minutes
+	Peak   float64   `json:"peak"`
+	PeakAt time.Time `json:"peak_at"`
+}
+
+// Returns the rolling APS at now
+func RollingAPS(store Store, now time.Time) (float64, error) {
+	points, err := Query(store, Minute, TOTAL_SERIES, now.Add(-APS_WINDOW*Minute.Step), now)
+	if err != nil {
+		return 0, err
+	}
+
+	var plays int64
+	for _, point := range points {
+		plays += point.Count
+	}
+
+	seconds := (APS_WINDOW * Minute.Step).Seconds() + now.Sub(Minute.Bucket(now)).Seconds()
+	return float64(plays) / seconds, nil
+}
+
+// Returns the highest APS of any whole minute before now, and when that
+// minute started
+func PeakAPS(store Store, now time.Time) (float64, time.Time, error) {
+	points, err := Query(store, Minute, TOTAL_SERIES, now.Add(-PEAK_WINDOW*Minute.Step), now.Add(-Minute.Step))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var peak Point
+	for _, point := range points {
+		if point.Count > peak.Count {
+			peak = point
+		}
+	}
+	return float64(peak.Count) / Minute.Step.Seconds(), peak.Time, nil
+}
+
+// Returns the rolling and peak APS at now
+func LoadThroughput(store Store, now time.Time) (*Throughput, error) {
+	var err error
+	throughput := &Throughput{}
+
+	if throughput.APS, err = RollingAPS(store, now); err != nil {
+		return nil, err
+	}
+
+	if throughput.Peak, throughput.PeakAt, err = PeakAPS(store, now); err != nil {
+		return nil, err
+	}
+	return throughput, nil
+}
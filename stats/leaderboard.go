@@ -0,0 +1,127 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Most entries a single leaderboard query may return
+	MAX_ENTRIES = 100
+
+	// Guilds by plays
+	GUILDS_BOARD = "guilds"
+
+	// Sounds by plays across every guild
+	SOUNDS_BOARD = "sounds"
+)
+
+// Period is the span of time a leaderboard covers
+type Period struct {
+	Name string
+
+	// Returns the part of the key naming the period holding t, empty if the
+	// period never ends
+	bucket func(t time.Time) string
+
+	// Returns when the boards of the period holding t can be dropped, zero if
+	// they're kept forever
+	expires func(t time.Time) time.Time
+}
+
+var (
+	AllTime = &Period{
+		Name:    "all",
+		bucket:  func(t time.Time) string { return "" },
+		expires: func(t time.Time) time.Time { return time.Time{} },
+	}
+
+	// Weeks are ISO weeks in UTC, and are kept a week after they end so the
+	// last one can still be shown
+	Week = &Period{
+		Name: "week",
+		bucket: func(t time.Time) string {
+			year, week := t.UTC().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		},
+		expires: func(t time.Time) time.Time {
+			t = t.UTC()
+			days := (int(time.Monday) - int(t.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+			next := time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, time.UTC)
+			return next.AddDate(0, 0, 7)
+		},
+	}
+
+	// Every period leaderboards are kept for
+	PERIODS = []*Period{Week, AllTime}
+
+	// Returned by Top when asked for too few or too many entries
+	ErrTooManyEntries = fmt.Errorf("leaderboards can show 1 to %d entries", MAX_ENTRIES)
+)
+
+// Entry is a user, guild or sound and its number of plays
+type Entry struct {
+	ID    string `json:"id"`
+	Count int64  `json:"count"`
+}
+
+// Returns the period with the given name, or nil
+func FindPeriod(name string) *Period {
+	for _, period := range PERIODS {
+		if period.Name == name {
+			return period
+		}
+	}
+	return nil
+}
+
+// Board of a guild's users by plays
+func GuildUsersBoard(guildID string) string {
+	return "guild:" + guildID + ":users"
+}
+
+// Board of the sounds played in a guild
+func GuildSoundsBoard(guildID string) string {
+	return "guild:" + guildID + ":sounds"
+}
+
+// Returns the key of a board for the period holding t
+func (p *Period) Key(board string, t time.Time) string {
+	if bucket := p.bucket(t); bucket != "" {
+		return fmt.Sprintf("airhorn:lb:%s:%s:%s", p.Name, bucket, board)
+	}
+	return fmt.Sprintf("airhorn:lb:%s:%s", p.Name, board)
+}
+
+// Counts a play at time t on every board for every period, as part of the
+// batch the rest of the play's stats use
+func trackLeaderboards(b Batch, t time.Time, userID, guildID, sound string) {
+	boards := []struct{ board, member string }{
+		{GUILDS_BOARD, guildID},
+		{SOUNDS_BOARD, sound},
+		{GuildUsersBoard(guildID), userID},
+		{GuildSoundsBoard(guildID), sound},
+	}
+
+	for _, period := range PERIODS {
+		expires := period.expires(t)
+		for _, board := range boards {
+			key := period.Key(board.board, t)
+			b.ZIncr(key, board.member)
+			if !expires.IsZero() {
+				b.ExpireAt(key, expires)
+			}
+		}
+	}
+}
+
+// Returns the top n entries of a board for the current period, most played first
+func Top(store Store, period *Period, board string, n int) ([]Entry, error) {
+	if n < 1 || n > MAX_ENTRIES {
+		return nil, ErrTooManyEntries
+	}
+	return store.ZRevRange(period.Key(board, time.Now()), 0, int64(n-1))
+}
@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWeekKeys(t *testing.T) {
+	date := func(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, loc)
+	}
+	berlin := time.FixedZone("CET", 60*60)
+
+	cases := []struct {
+		name    string
+		t       time.Time
+		key     string
+		expires time.Time
+	}{
+		// ISO weeks start on Monday, and the first holds the year's first Thursday
+		{"sunday", date(2016, time.January, 3, 12, time.UTC), "airhorn:lb:week:2015-W53:guilds", date(2016, time.January, 11, 0, time.UTC)},
+		{"monday", date(2016, time.January, 4, 0, time.UTC), "airhorn:lb:week:2016-W01:guilds", date(2016, time.January, 18, 0, time.UTC)},
+		{"december", date(2014, time.December, 31, 12, time.UTC), "airhorn:lb:week:2015-W01:guilds", date(2015, time.January, 12, 0, time.UTC)},
+
+		// Weeks are in UTC, this is still Sunday there
+		{"timezone", date(2016, time.January, 4, 0, berlin), "airhorn:lb:week:2015-W53:guilds", date(2016, time.January, 11, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		if key := Week.Key(GUILDS_BOARD, c.t); key != c.key {
+			t.Errorf("%s: key is %s, expected %s", c.name, key, c.key)
+		}
+
+		if expires := Week.expires(c.t); !expires.Equal(c.expires) {
+			t.Errorf("%s: expires at %s, expected %s", c.name, expires, c.expires)
+		}
+	}
+
+	now := time.Now()
+	if key := AllTime.Key(GuildUsersBoard("10"), now); key != "airhorn:lb:all:guild:10:users" {
+		t.Errorf("All time key is %s", key)
+	}
+
+	if expires := AllTime.expires(now); !expires.IsZero() {
+		t.Errorf("All time boards expire at %s", expires)
+	}
+}
+
+func TestTop(t *testing.T) {
+	now := time.Now()
+	plays := []*PlayRecord{
+		{GuildID: "10", UserID: "1", Sound: "echo"},
+		{GuildID: "10", UserID: "1", Sound: "echo"},
+		{GuildID: "10", UserID: "2", Sound: "default"},
+		{GuildID: "11", UserID: "1", Sound: "echo"},
+	}
+
+	// Last week's plays only count for all time
+	lastWeek := &PlayRecord{Time: now.AddDate(0, 0, -7), GuildID: "11", ChannelID: "21", UserID: "3", Sound: "spam"}
+
+	cases := []struct {
+		period  *Period
+		board   string
+		n       int
+		entries []Entry
+	}{
+		{AllTime, GUILDS_BOARD, 10, []Entry{{"10", 3}, {"11", 2}}},
+		{Week, GUILDS_BOARD, 10, []Entry{{"10", 3}, {"11", 1}}},
+		{Week, SOUNDS_BOARD, 1, []Entry{{"echo", 3}}},
+		{Week, GuildUsersBoard("10"), 10, []Entry{{"1", 2}, {"2", 1}}},
+		{AllTime, GuildSoundsBoard("11"), 10, []Entry{{"echo", 1}, {"spam", 1}}},
+	}
+
+	for _, kind := range testStoreKinds {
+		store, cleanup := openTestStore(t, kind)
+		for _, play := range plays {
+			play.Time, play.ChannelID, play.Collection = now, "20", "airhorn"
+			if err := Track(store, play); err != nil {
+				t.Fatalf("%s: %s", kind, err)
+			}
+		}
+
+		if err := Track(store, lastWeek); err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+
+		for _, c := range cases {
+			entries, err := Top(store, c.period, c.board, c.n)
+			if err != nil {
+				t.Errorf("%s: %s %s: %s", kind, c.period.Name, c.board, err)
+				continue
+			}
+
+			// Ties have no order
+			if len(entries) == 2 && entries[0].Count == entries[1].Count && entries[0].ID > entries[1].ID {
+				entries[0], entries[1] = entries[1], entries[0]
+			}
+
+			if !reflect.DeepEqual(entries, c.entries) {
+				t.Errorf("%s: %s %s is %v, expected %v", kind, c.period.Name, c.board, entries, c.entries)
+			}
+		}
+
+		for _, n := range []int{0, MAX_ENTRIES + 1} {
+			if _, err := Top(store, AllTime, GUILDS_BOARD, n); err != ErrTooManyEntries {
+				t.Errorf("%s: %d entries returned %v, expected %v", kind, n, err, ErrTooManyEntries)
+			}
+		}
+		cleanup()
+	}
+}
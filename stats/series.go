@@ -0,0 +1,147 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Most points a single series query may return
+	MAX_POINTS = 1440
+
+	// Series of every play, sounds and guilds have their own
+	TOTAL_SERIES = "total"
+)
+
+// Resolution is how much time each bucket of a series covers, and how long
+// buckets are kept before they expire
+type Resolution struct {
+	Name string
+	Step time.Duration
+
+	// Zero keeps buckets forever
+	TTL time.Duration
+}
+
+var (
+	Minute = &Resolution{"minute", time.Minute, 48 * time.Hour}
+	Hour   = &Resolution{"hour", time.Hour, 30 * 24 * time.Hour}
+	Day    = &Resolution{"day", 24 * time.Hour, 0}
+
+	// Every resolution plays are counted at, from finest to coarsest
+	RESOLUTIONS = []*Resolution{Minute, Hour, Day}
+
+	errUnknownSeries = errors.New("series are total, sound:<name> or guild:<id>")
+
+	// Returned by Query for ranges it won't look up
+	ErrInvalidRange  = errors.New("the end of a series can't be before its start")
+	ErrTooManyPoints = fmt.Errorf("series can have up to %d points", MAX_POINTS)
+)
+
+// Point is the number of plays in the bucket starting at Time
+type Point struct {
+	Time  time.Time `json:"time"`
+	Count int64     `json:"count"`
+}
+
+// Returns the resolution with the given name, or nil
+func FindResolution(name string) *Resolution {
+	for _, res := range RESOLUTIONS {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+// Series of the plays of one sound
+func SoundSeries(name string) string {
+	return "sound:" + name
+}
+
+// Series of the plays in one guild
+func GuildSeries(guildID string) string {
+	return "guild:" + guildID
+}
+
+// Checks a series name given by a user
+func ValidSeries(series string) error {
+	if series == TOTAL_SERIES {
+		return nil
+	}
+
+	parts := strings.SplitN(series, ":", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "sound" && parts[0] != "guild") {
+		return errUnknownSeries
+	}
+	return nil
+}
+
+// Returns the start of the bucket holding t, buckets are aligned to UTC
+func (r *Resolution) Bucket(t time.Time) time.Time {
+	return t.UTC().Truncate(r.Step)
+}
+
+// Returns the key of the bucket holding t
+func (r *Resolution) Key(series string, t time.Time) string {
+	return fmt.Sprintf("airhorn:ts:%s:%s:%d", r.Name, series, r.Bucket(t).Unix())
+}
+
+// Counts a play at time t in the total, sound and guild series at every
+// resolution, as part of the batch the rest of the play's stats use
+func trackSeries(b Batch, t time.Time, sound, guildID string) {
+	for _, res := range RESOLUTIONS {
+		for _, series := range []string{TOTAL_SERIES, SoundSeries(sound), GuildSeries(guildID)} {
+			key := res.Key(series, t)
+			b.Incr(key)
+
+			// Keep a bucket a full TTL past its end, so it never expires early
+			if res.TTL > 0 {
+				b.ExpireAt(key, res.Bucket(t).Add(res.Step+res.TTL))
+			}
+		}
+	}
+}
+
+// Returns the buckets of a series between from and to, oldest first. Buckets
+// with no plays, or that already expired, count zero.
+func Query(store Store, res *Resolution, series string, from, to time.Time) ([]Point, error) {
+	from, to = res.Bucket(from), res.Bucket(to)
+	if to.Before(from) {
+		return nil, ErrInvalidRange
+	}
+
+	n := int(to.Sub(from)/res.Step) + 1
+	if n > MAX_POINTS {
+		return nil, ErrTooManyPoints
+	}
+
+	points := make([]Point, n)
+	keys := make([]string, n)
+	for i := range points {
+		points[i].Time = from.Add(time.Duration(i) * res.Step)
+		keys[i] = res.Key(series, points[i].Time)
+	}
+
+	counts, err := store.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, count := range counts {
+		points[i].Count = count
+	}
+	return points, nil
+}
+
+// Returns the last n buckets of a series, ending with the current one
+func QueryLast(store Store, res *Resolution, series string, n int) ([]Point, error) {
+	if n < 1 {
+		n = 1
+	}
+
+	to := time.Now()
+	return Query(store, res, series, to.Add(-time.Duration(n-1)*res.Step), to)
+}
@@ -0,0 +1,147 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the counts of a series' points
+func pointCounts(points []Point) []int64 {
+	counts := make([]int64, len(points))
+	for i, point := range points {
+		counts[i] = point.Count
+	}
+	return counts
+}
+
+func TestQuerySeries(t *testing.T) {
+	// Yesterday at 10:00 UTC, so no bucket has expired yet
+	base := time.Now().UTC().Truncate(24 * time.Hour).Add(-14 * time.Hour)
+	at := func(d time.Duration) time.Time {
+		return base.Add(d)
+	}
+
+	plays := []*PlayRecord{
+		{Time: at(30 * time.Second), Sound: "echo"},
+		{Time: at(59 * time.Second), Sound: "default"},
+		{Time: at(time.Minute), Sound: "echo"},
+		{Time: at(90 * time.Minute), Sound: "echo"},
+	}
+
+	cases := []struct {
+		res    *Resolution
+		series string
+		from   time.Time
+		to     time.Time
+		counts []int64
+	}{
+		{Minute, TOTAL_SERIES, at(45 * time.Second), at(2*time.Minute + 10*time.Second), []int64{2, 1, 0}},
+		{Minute, SoundSeries("echo"), at(0), at(time.Minute), []int64{1, 1}},
+		{Minute, GuildSeries("10"), at(time.Minute), at(time.Minute), []int64{1}},
+		{Hour, TOTAL_SERIES, at(-time.Minute), at(90 * time.Minute), []int64{0, 3, 1}},
+		{Hour, SoundSeries("default"), at(0), at(time.Hour), []int64{1, 0}},
+		{Day, TOTAL_SERIES, at(-11 * time.Hour), at(0), []int64{0, 4}},
+
+		// Buckets are aligned to UTC whatever zone the range is given in
+		{Hour, TOTAL_SERIES, at(0).In(time.FixedZone("UTC+2", 2*60*60)), at(time.Hour).In(time.FixedZone("UTC-5", -5*60*60)), []int64{3, 1}},
+	}
+
+	for _, kind := range testStoreKinds {
+		store, cleanup := openTestStore(t, kind)
+		for _, play := range plays {
+			play.GuildID, play.ChannelID, play.UserID, play.Collection = "10", "20", "1", "airhorn"
+			if err := Track(store, play); err != nil {
+				t.Fatalf("%s: %s", kind, err)
+			}
+		}
+
+		for _, c := range cases {
+			points, err := Query(store, c.res, c.series, c.from, c.to)
+			if err != nil {
+				t.Errorf("%s: %s %s: %s", kind, c.res.Name, c.series, err)
+				continue
+			}
+
+			if counts := pointCounts(points); !reflect.DeepEqual(counts, c.counts) {
+				t.Errorf("%s: %s %s from %s is %v, expected %v", kind, c.res.Name, c.series, c.from, counts, c.counts)
+			}
+
+			if start := c.res.Bucket(c.from); !points[0].Time.Equal(start) || points[0].Time.Location() != time.UTC {
+				t.Errorf("%s: %s %s starts at %s, expected %s", kind, c.res.Name, c.series, points[0].Time, start)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+
+	if _, err := Query(store, Minute, TOTAL_SERIES, now, now.Add(-time.Minute)); err != ErrInvalidRange {
+		t.Errorf("Backwards range returned %v, expected %v", err, ErrInvalidRange)
+	}
+
+	if _, err := Query(store, Minute, TOTAL_SERIES, now.Add(-MAX_POINTS*time.Minute), now); err != ErrTooManyPoints {
+		t.Errorf("Range of %d points returned %v, expected %v", MAX_POINTS+1, err, ErrTooManyPoints)
+	}
+
+	points, err := QueryLast(store, Hour, TOTAL_SERIES, 24)
+	if err != nil || len(points) != 24 || !points[23].Time.Equal(Hour.Bucket(now)) {
+		t.Errorf("Last 24 hours are %v (%v), expected 24 ending with the current hour", points, err)
+	}
+}
+
+func TestSeriesExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	play := time.Now().UTC().Truncate(time.Hour).Add(10 * time.Minute)
+	Track(store, &PlayRecord{Time: play, GuildID: "10", ChannelID: "20", UserID: "1", Sound: "echo"})
+
+	// Buckets are kept a full TTL past their end
+	expected := map[string]time.Time{
+		Minute.Key(TOTAL_SERIES, play): Minute.Bucket(play).Add(time.Minute + Minute.TTL),
+		Hour.Key(TOTAL_SERIES, play):   Hour.Bucket(play).Add(time.Hour + Hour.TTL),
+		Day.Key(TOTAL_SERIES, play):    {},
+	}
+
+	seen := 0
+	err := store.Dump(func(r *Record) error {
+		expires, exists := expected[r.Key]
+		if !exists {
+			return nil
+		}
+
+		seen++
+		if !r.Expires.Equal(expires) {
+			t.Errorf("%s expires at %s, expected %s", r.Key, r.Expires, expires)
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen != len(expected) {
+		t.Errorf("Dumped %d of the %d total buckets", seen, len(expected))
+	}
+}
+
+func TestValidSeries(t *testing.T) {
+	cases := map[string]bool{
+		"total":     true,
+		"sound:foo": true,
+		"guild:123": true,
+		"sound:":    false,
+		"user:1":    false,
+		"totals":    false,
+		"":          false,
+	}
+
+	for series, valid := range cases {
+		if err := ValidSeries(series); (err == nil) != valid {
+			t.Errorf("%q: got error %v, expected valid %v", series, err, valid)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package stats keeps airhorn's stats, shared by the bot that writes them and
+// the webserver that reads them. They can live in redis, a bolt file or memory,
+// and be read over HTTP from a process that has them open.
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Kinds of values a store holds
+const (
+	KIND_COUNTER = "counter"
+	KIND_SET     = "set"
+	KIND_ZSET    = "zset"
+	KIND_HASH    = "hash"
+)
+
+// Store is where stats are kept. It holds counters, sets, sorted sets and
+// hashes by key, modelled on redis, so every backend can answer the same
+// queries and stats can be copied between them.
+type Store interface {
+	// Applies a batch of writes. Redis sends them in one pipeline, bolt
+	// commits them in one transaction.
+	Update(fn func(b Batch)) error
+
+	// Returns a counter, zero if it doesn't exist
+	Get(key string) (int64, error)
+	MGet(keys ...string) ([]int64, error)
+
+	SCard(key string) (int64, error)
+	HGetAll(key string) (map[string]string, error)
+
+	// Returns the members of a sorted set from start to stop (inclusive, -1
+	// for the end) by score, highest first
+	ZRevRange(key string, start, stop int64) ([]Entry, error)
+
+	// Returns the 0-based rank of a member by score, highest first, and
+	// false if it isn't in the set
+	ZRevRank(key, member string) (int64, bool, error)
+	ZScore(key, member string) (int64, error)
+
+	// Calls fn with every stats key in the store
+	Dump(fn func(r *Record) error) error
+
+	// Replaces a key with the one in r
+	Restore(r *Record) error
+
+	Close() error
+}
+
+// Batch is a set of writes applied together by Store.Update
+type Batch interface {
+	Incr(key string)
+	SAdd(key, member string)
+	ZIncr(key, member string)
+	HSet(key, field, value string)
+	HSetNX(key, field, value string)
+	HIncr(key, field string)
+
+	// Drops the key at t
+	ExpireAt(key string, t time.Time)
+}
+
+// Record is one key and everything in it, as read by Store.Dump
+type Record struct {
+	Key  string
+	Kind string
+
+	Counter int64
+	Members []string
+	Scores  map[string]int64
+	Fields  map[string]string
+
+	// Zero if the key never expires
+	Expires time.Time
+}
+
+// Patterns of every key holding stats, other airhorn keys like settings are
+// never dumped
+var STATS_PATTERNS = []string{
+	"airhorn:total",
+	"airhorn:a:*",
+	"airhorn:f:*",
+	"airhorn:ts:*",
+	"airhorn:lb:*",
+	"airhorn:user:*",
+}
+
+// Whether a key holds stats
+func isStatsKey(key string) bool {
+	for _, pattern := range STATS_PATTERNS {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(key, pattern[:len(pattern)-1]) || key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the store described by spec. That's redis (using rcli), redis://<addr>,
+// bolt://<path>, http://<addr> to read a bot's stats (see NewHTTPStore) or
+// memory.
+func Open(spec string, rcli *redis.Client) (Store, error) {
+	switch {
+	case spec == "redis":
+		if rcli == nil {
+			return nil, fmt.Errorf("the redis stats store needs a redis connection")
+		}
+		return NewRedisStore(rcli), nil
+	case strings.HasPrefix(spec, "redis://"):
+		rcli = redis.NewClient(&redis.Options{Addr: strings.TrimPrefix(spec, "redis://"), DB: 0})
+		if err := rcli.Ping().Err(); err != nil {
+			return nil, err
+		}
+		return &redisStore{rcli: rcli, owned: true}, nil
+	case strings.HasPrefix(spec, "bolt://"):
+		return NewBoltStore(strings.TrimPrefix(spec, "bolt://"))
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		store := NewHTTPStore(spec)
+		if _, err := store.Get("airhorn:total"); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case spec == "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("stats stores are redis, redis://<addr>, bolt://<path>, http://<addr> or memory")
+}
+
+// Copies every stats key from one store to another, replacing the keys that
+// already exist there. Returns the number of keys copied.
+func Migrate(from, to Store) (int, error) {
+	n := 0
+	err := from.Dump(func(r *Record) error {
+		if err := to.Restore(r); err != nil {
+			return fmt.Errorf("%s: %s", r.Key, err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
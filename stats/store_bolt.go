@@ -0,0 +1,423 @@
+package stats
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// How often the bolt store drops keys that expired
+	BOLT_SWEEP_INTERVAL = 10 * time.Minute
+
+	// How long to wait for another process to let go of the database file
+	BOLT_OPEN_TIMEOUT = 5 * time.Second
+)
+
+// Top-level buckets, sets, sorted sets and hashes have a bucket per key
+// inside theirs
+var (
+	boltCounters = []byte("counters")
+	boltSets     = []byte("sets")
+	boltZSets    = []byte("zsets")
+	boltHashes   = []byte("hashes")
+	boltExpires  = []byte("expires")
+
+	boltBuckets = [][]byte{boltCounters, boltSets, boltZSets, boltHashes, boltExpires}
+
+	errUnknownKind = errors.New("unknown record kind")
+)
+
+// boltStore keeps stats in a single bolt database file, for bots too small to
+// need a redis server
+type boltStore struct {
+	db *bolt.DB
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Opens, or creates, a store keeping stats in the bolt database at path
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &boltStore{db: db, done: make(chan struct{})}
+	go s.sweepLoop()
+	return s, nil
+}
+
+func itoa(n int64) []byte {
+	return []byte(strconv.FormatInt(n, 10))
+}
+
+func atoi(b []byte) int64 {
+	n, _ := strconv.ParseInt(string(b), 10, 64)
+	return n
+}
+
+// Whether a key expired
+func boltExpired(tx *bolt.Tx, key string) bool {
+	at := tx.Bucket(boltExpires).Get([]byte(key))
+	return at != nil && time.Now().UnixNano() >= atoi(at)
+}
+
+// Removes a key and its expiry
+func boltDelete(tx *bolt.Tx, key string) error {
+	k := []byte(key)
+	if err := tx.Bucket(boltCounters).Delete(k); err != nil {
+		return err
+	}
+
+	for _, name := range [][]byte{boltSets, boltZSets, boltHashes} {
+		if tx.Bucket(name).Bucket(k) != nil {
+			if err := tx.Bucket(name).DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(boltExpires).Delete(k)
+}
+
+// Returns the bucket holding a key of a kind, nil if it doesn't exist or
+// expired
+func boltBucket(tx *bolt.Tx, kind []byte, key string) *bolt.Bucket {
+	if boltExpired(tx, key) {
+		return nil
+	}
+	return tx.Bucket(kind).Bucket([]byte(key))
+}
+
+// Drops every expired key until the store is closed
+func (s *boltStore) sweepLoop() {
+	for {
+		s.sweep()
+
+		select {
+		case <-time.After(BOLT_SWEEP_INTERVAL):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *boltStore) sweep() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		expired := make([]string, 0)
+		now := time.Now().UnixNano()
+		tx.Bucket(boltExpires).ForEach(func(k, v []byte) error {
+			if now >= atoi(v) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+
+		for _, key := range expired {
+			if err := boltDelete(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltBatch applies writes inside a transaction, keeping the first error
+type boltBatch struct {
+	tx  *bolt.Tx
+	err error
+}
+
+// Drops a key that expired before writing to it, so it starts over like it
+// would in redis
+func (b *boltBatch) prepare(key string) bool {
+	if b.err == nil && boltExpired(b.tx, key) {
+		b.err = boltDelete(b.tx, key)
+	}
+	return b.err == nil
+}
+
+// Returns the bucket holding a key, creating it
+func (b *boltBatch) bucket(kind []byte, key string) *bolt.Bucket {
+	if !b.prepare(key) {
+		return nil
+	}
+
+	bucket, err := b.tx.Bucket(kind).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		b.err = err
+		return nil
+	}
+	return bucket
+}
+
+func (b *boltBatch) put(bucket *bolt.Bucket, k, v []byte) {
+	if bucket != nil && b.err == nil {
+		b.err = bucket.Put(k, v)
+	}
+}
+
+func (b *boltBatch) Incr(key string) {
+	if b.prepare(key) {
+		counters := b.tx.Bucket(boltCounters)
+		b.put(counters, []byte(key), itoa(atoi(counters.Get([]byte(key)))+1))
+	}
+}
+
+func (b *boltBatch) SAdd(key, member string) {
+	b.put(b.bucket(boltSets, key), []byte(member), []byte{})
+}
+
+func (b *boltBatch) ZIncr(key, member string) {
+	if bucket := b.bucket(boltZSets, key); bucket != nil {
+		b.put(bucket, []byte(member), itoa(atoi(bucket.Get([]byte(member)))+1))
+	}
+}
+
+func (b *boltBatch) HSet(key, field, value string) {
+	b.put(b.bucket(boltHashes, key), []byte(field), []byte(value))
+}
+
+func (b *boltBatch) HSetNX(key, field, value string) {
+	if bucket := b.bucket(boltHashes, key); bucket != nil && bucket.Get([]byte(field)) == nil {
+		b.put(bucket, []byte(field), []byte(value))
+	}
+}
+
+func (b *boltBatch) HIncr(key, field string) {
+	if bucket := b.bucket(boltHashes, key); bucket != nil {
+		b.put(bucket, []byte(field), itoa(atoi(bucket.Get([]byte(field)))+1))
+	}
+}
+
+func (b *boltBatch) ExpireAt(key string, t time.Time) {
+	b.put(b.tx.Bucket(boltExpires), []byte(key), itoa(t.UnixNano()))
+}
+
+// Writes from concurrent plays are coalesced into one transaction by bolt
+func (s *boltStore) Update(fn func(b Batch)) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b := &boltBatch{tx: tx}
+		fn(b)
+		return b.err
+	})
+}
+
+func (s *boltStore) Get(key string) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if !boltExpired(tx, key) {
+			n = atoi(tx.Bucket(boltCounters).Get([]byte(key)))
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) MGet(keys ...string) ([]int64, error) {
+	counts := make([]int64, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			if !boltExpired(tx, key) {
+				counts[i] = atoi(tx.Bucket(boltCounters).Get([]byte(key)))
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+func (s *boltStore) SCard(key string) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := boltBucket(tx, boltSets, key); bucket != nil {
+			n = int64(bucket.Stats().KeyN)
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) HGetAll(key string) (map[string]string, error) {
+	fields := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltBucket(tx, boltHashes, key)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			fields[string(k)] = string(v)
+			return nil
+		})
+	})
+	return fields, err
+}
+
+// Returns a sorted set's members from the highest score
+func boltZRevRange(tx *bolt.Tx, key string) []Entry {
+	members := make([]Entry, 0)
+	if bucket := boltBucket(tx, boltZSets, key); bucket != nil {
+		bucket.ForEach(func(k, v []byte) error {
+			members = append(members, Entry{ID: string(k), Count: atoi(v)})
+			return nil
+		})
+	}
+	sort.Sort(byCountDesc(members))
+	return members
+}
+
+func (s *boltStore) ZRevRange(key string, start, stop int64) ([]Entry, error) {
+	var members []Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		members = sliceRange(boltZRevRange(tx, key), start, stop)
+		return nil
+	})
+	return members, err
+}
+
+func (s *boltStore) ZRevRank(key, member string) (int64, bool, error) {
+	var rank int64
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for i, entry := range boltZRevRange(tx, key) {
+			if entry.ID == member {
+				rank, found = int64(i), true
+				break
+			}
+		}
+		return nil
+	})
+	return rank, found, err
+}
+
+func (s *boltStore) ZScore(key, member string) (int64, error) {
+	var score int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := boltBucket(tx, boltZSets, key); bucket != nil {
+			score = atoi(bucket.Get([]byte(member)))
+		}
+		return nil
+	})
+	return score, err
+}
+
+func (s *boltStore) Dump(fn func(r *Record) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		expires := func(key string) time.Time {
+			if at := tx.Bucket(boltExpires).Get([]byte(key)); at != nil {
+				return time.Unix(0, atoi(at))
+			}
+			return time.Time{}
+		}
+
+		err := tx.Bucket(boltCounters).ForEach(func(k, v []byte) error {
+			key := string(k)
+			if boltExpired(tx, key) || !isStatsKey(key) {
+				return nil
+			}
+			return fn(&Record{Key: key, Kind: KIND_COUNTER, Counter: atoi(v), Expires: expires(key)})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// Every other kind has a bucket per key
+		kinds := []struct {
+			name []byte
+			kind string
+		}{{boltSets, KIND_SET}, {boltZSets, KIND_ZSET}, {boltHashes, KIND_HASH}}
+
+		for _, kind := range kinds {
+			err = tx.Bucket(kind.name).ForEach(func(k, v []byte) error {
+				key := string(k)
+				if boltExpired(tx, key) || !isStatsKey(key) {
+					return nil
+				}
+
+				r := &Record{Key: key, Kind: kind.kind, Expires: expires(key)}
+				r.Scores, r.Fields = make(map[string]int64), make(map[string]string)
+				tx.Bucket(kind.name).Bucket(k).ForEach(func(field, value []byte) error {
+					switch kind.kind {
+					case KIND_SET:
+						r.Members = append(r.Members, string(field))
+					case KIND_ZSET:
+						r.Scores[string(field)] = atoi(value)
+					case KIND_HASH:
+						r.Fields[string(field)] = string(value)
+					}
+					return nil
+				})
+				return fn(r)
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Restore(r *Record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := boltDelete(tx, r.Key); err != nil {
+			return err
+		}
+
+		b := &boltBatch{tx: tx}
+		switch r.Kind {
+		case KIND_COUNTER:
+			b.put(tx.Bucket(boltCounters), []byte(r.Key), itoa(r.Counter))
+		case KIND_SET:
+			bucket := b.bucket(boltSets, r.Key)
+			for _, member := range r.Members {
+				b.put(bucket, []byte(member), []byte{})
+			}
+		case KIND_ZSET:
+			bucket := b.bucket(boltZSets, r.Key)
+			for member, score := range r.Scores {
+				b.put(bucket, []byte(member), itoa(score))
+			}
+		case KIND_HASH:
+			bucket := b.bucket(boltHashes, r.Key)
+			for field, value := range r.Fields {
+				b.put(bucket, []byte(field), []byte(value))
+			}
+		default:
+			return errUnknownKind
+		}
+
+		if !r.Expires.IsZero() {
+			b.ExpireAt(r.Key, r.Expires)
+		}
+		return b.err
+	})
+}
+
+func (s *boltStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.db.Close()
+}
@@ -0,0 +1,283 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Path NewHandler is served on, under the address given to NewHTTPStore
+const HTTP_STORE_PATH = "/stats/store"
+
+// How long a read over HTTP may take, dumps aren't limited
+const HTTP_STORE_TIMEOUT = 10 * time.Second
+
+var ErrReadOnly = errors.New("stats read over http can't be written")
+
+// httpRequest is one read sent to NewHandler
+type httpRequest struct {
+	Op     string   `json:"op"`
+	Keys   []string `json:"keys"`
+	Member string   `json:"member,omitempty"`
+	Start  int64    `json:"start,omitempty"`
+	Stop   int64    `json:"stop,omitempty"`
+}
+
+// httpReply is NewHandler's answer to a read, dumps send one per record
+type httpReply struct {
+	Counts  []int64           `json:"counts,omitempty"`
+	Count   int64             `json:"count,omitempty"`
+	Found   bool              `json:"found,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Entries []Entry           `json:"entries,omitempty"`
+	Record  *Record           `json:"record,omitempty"`
+	Error   string            `json:"error,omitempty"`
+
+	// Set on the reply after a dump's last record
+	Done bool `json:"done,omitempty"`
+}
+
+// Returns a handler answering reads of the stats in s, so a process that
+// can't open the store itself (like the webserver, when the bot holds a bolt
+// file) can read it with NewHTTPStore. Writes and keys that aren't stats are
+// refused.
+func NewHandler(s Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Reads are POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := &httpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, key := range req.Keys {
+			if !isStatsKey(key) {
+				http.Error(w, fmt.Sprintf("%s isn't a stat", key), http.StatusForbidden)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+
+		if req.Op == "dump" {
+			err := s.Dump(func(record *Record) error {
+				return enc.Encode(&httpReply{Record: record})
+			})
+			if err != nil {
+				enc.Encode(&httpReply{Error: err.Error()})
+			} else {
+				enc.Encode(&httpReply{Done: true})
+			}
+			return
+		}
+
+		reply, err := answerRead(s, req)
+		if err != nil {
+			reply = &httpReply{Error: err.Error()}
+		}
+		enc.Encode(reply)
+	})
+}
+
+// Runs a read against a store
+func answerRead(s Store, req *httpRequest) (*httpReply, error) {
+	if req.Op != "mget" && len(req.Keys) != 1 {
+		return nil, fmt.Errorf("%s takes one key", req.Op)
+	}
+
+	var (
+		reply = &httpReply{}
+		err   error
+	)
+
+	switch req.Op {
+	case "mget":
+		reply.Counts, err = s.MGet(req.Keys...)
+	case "scard":
+		reply.Count, err = s.SCard(req.Keys[0])
+	case "hgetall":
+		reply.Fields, err = s.HGetAll(req.Keys[0])
+	case "zrevrange":
+		reply.Entries, err = s.ZRevRange(req.Keys[0], req.Start, req.Stop)
+	case "zrevrank":
+		reply.Count, reply.Found, err = s.ZRevRank(req.Keys[0], req.Member)
+	case "zscore":
+		reply.Count, err = s.ZScore(req.Keys[0], req.Member)
+	default:
+		return nil, fmt.Errorf("unknown read %s", req.Op)
+	}
+	return reply, err
+}
+
+// httpStore reads stats served by NewHandler, usually by a running bot
+type httpStore struct {
+	url    string
+	client *http.Client
+}
+
+// Returns a store reading the stats served at addr, e.g. http://localhost:9100
+// for a bot run with -metrics :9100. Writes return ErrReadOnly.
+func NewHTTPStore(addr string) Store {
+	return &httpStore{
+		url:    strings.TrimSuffix(addr, "/") + HTTP_STORE_PATH,
+		client: &http.Client{Timeout: HTTP_STORE_TIMEOUT},
+	}
+}
+
+// Sends a read, the caller closes the response's body
+func (s *httpStore) post(client *http.Client, req *httpRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stats server returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *httpStore) read(req *httpRequest) (*httpReply, error) {
+	resp, err := s.post(s.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reply := &httpReply{}
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+func (s *httpStore) Update(fn func(b Batch)) error {
+	return ErrReadOnly
+}
+
+func (s *httpStore) Get(key string) (int64, error) {
+	counts, err := s.MGet(key)
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+func (s *httpStore) MGet(keys ...string) ([]int64, error) {
+	reply, err := s.read(&httpRequest{Op: "mget", Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply.Counts) != len(keys) {
+		return nil, fmt.Errorf("stats server returned %d counters for %d keys", len(reply.Counts), len(keys))
+	}
+	return reply.Counts, nil
+}
+
+func (s *httpStore) SCard(key string) (int64, error) {
+	reply, err := s.read(&httpRequest{Op: "scard", Keys: []string{key}})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Count, nil
+}
+
+func (s *httpStore) HGetAll(key string) (map[string]string, error) {
+	reply, err := s.read(&httpRequest{Op: "hgetall", Keys: []string{key}})
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Fields == nil {
+		return map[string]string{}, nil
+	}
+	return reply.Fields, nil
+}
+
+func (s *httpStore) ZRevRange(key string, start, stop int64) ([]Entry, error) {
+	reply, err := s.read(&httpRequest{Op: "zrevrange", Keys: []string{key}, Start: start, Stop: stop})
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Entries == nil {
+		return []Entry{}, nil
+	}
+	return reply.Entries, nil
+}
+
+func (s *httpStore) ZRevRank(key, member string) (int64, bool, error) {
+	reply, err := s.read(&httpRequest{Op: "zrevrank", Keys: []string{key}, Member: member})
+	if err != nil {
+		return 0, false, err
+	}
+	return reply.Count, reply.Found, nil
+}
+
+func (s *httpStore) ZScore(key, member string) (int64, error) {
+	reply, err := s.read(&httpRequest{Op: "zscore", Keys: []string{key}, Member: member})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Count, nil
+}
+
+func (s *httpStore) Dump(fn func(r *Record) error) error {
+	// Dumps take as long as the store is big
+	resp, err := s.post(&http.Client{}, &httpRequest{Op: "dump"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		reply := &httpReply{}
+		if err := dec.Decode(reply); err != nil {
+			return err
+		}
+
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+
+		if reply.Done {
+			return nil
+		}
+
+		if reply.Record != nil {
+			if err := fn(reply.Record); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.New("stats server ended the dump early")
+}
+
+func (s *httpStore) Restore(r *Record) error {
+	return ErrReadOnly
+}
+
+func (s *httpStore) Close() error {
+	return nil
+}
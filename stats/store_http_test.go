@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPStore(t *testing.T) {
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	for _, kind := range testStoreKinds {
+		served, cleanup := openTestStore(t, kind)
+		fillTestStore(t, served, expires)
+
+		server := httptest.NewServer(NewHandler(served))
+		store, err := Open(server.URL, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+
+		counts, err := store.MGet("airhorn:total", "airhorn:ts:m:total:1", "airhorn:f:total")
+		if err != nil || !reflect.DeepEqual(counts, []int64{2, 1, 0}) {
+			t.Errorf("%s: read counters %v (%v), expected [2 1 0]", kind, counts, err)
+		}
+
+		if n, err := store.SCard("airhorn:a:users"); n != 2 || err != nil {
+			t.Errorf("%s: read a set of %d (%v), expected 2", kind, n, err)
+		}
+
+		fields, err := store.HGetAll("airhorn:user:1")
+		if err != nil || fields["first"] != "100" || fields["forced"] != "1" {
+			t.Errorf("%s: read hash %v (%v)", kind, fields, err)
+		}
+
+		entries, err := store.ZRevRange("airhorn:lb:users:all", 0, -1)
+		if err != nil || !reflect.DeepEqual(entries, []Entry{{"1", 2}, {"2", 1}}) {
+			t.Errorf("%s: read board %v (%v), expected 1 then 2", kind, entries, err)
+		}
+
+		if rank, found, err := store.ZRevRank("airhorn:lb:users:all", "2"); rank != 1 || !found || err != nil {
+			t.Errorf("%s: read rank %d %v (%v), expected 1", kind, rank, found, err)
+		}
+
+		if _, found, _ := store.ZRevRank("airhorn:lb:users:all", "3"); found {
+			t.Errorf("%s: found a rank for a missing member", kind)
+		}
+
+		if score, err := store.ZScore("airhorn:lb:users:all", "1"); score != 2 || err != nil {
+			t.Errorf("%s: read score %d (%v), expected 2", kind, score, err)
+		}
+
+		// Dumps match the store they're served from, so they can be migrated
+		expected, records := dumpTestStore(t, served), dumpTestStore(t, store)
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("%s: dumped %v, expected %v", kind, records, expected)
+		}
+
+		// Writes and keys that aren't stats are refused
+		if err := store.Update(func(b Batch) { b.Incr("airhorn:total") }); err != ErrReadOnly {
+			t.Errorf("%s: update returned %v, expected %v", kind, err, ErrReadOnly)
+		}
+
+		if _, err := store.HGetAll("airhorn:guild:1:settings"); err == nil {
+			t.Errorf("%s: read a key that isn't a stat", kind)
+		}
+
+		server.Close()
+		cleanup()
+	}
+}
+
+func TestHTTPStoreErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	if _, err := Open(server.URL, nil); err == nil {
+		t.Error("Opened a server that doesn't serve stats")
+	}
+
+	// A dump cut off before its end is an error
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"record": {"Key": "airhorn:total", "Kind": "counter", "Counter": 1}}` + "\n"))
+	}))
+	defer server.Close()
+
+	err := NewHTTPStore(server.URL).Dump(func(r *Record) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "early") {
+		t.Errorf("Cut off dump returned %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package stats
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps stats in maps, they're gone when the process exits
+type memoryStore struct {
+	sync.RWMutex
+
+	counters map[string]int64
+	sets     map[string]map[string]bool
+	zsets    map[string]map[string]int64
+	hashes   map[string]map[string]string
+	expires  map[string]time.Time
+
+	// When expired keys were last dropped
+	swept time.Time
+}
+
+// How often the memory store drops keys that expired
+const MEMORY_SWEEP_INTERVAL = time.Minute
+
+// Returns a store keeping stats in memory, for tests and trying the bot out
+func NewMemoryStore() Store {
+	return &memoryStore{
+		counters: make(map[string]int64),
+		sets:     make(map[string]map[string]bool),
+		zsets:    make(map[string]map[string]int64),
+		hashes:   make(map[string]map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+}
+
+// Drops a key if it expired, callers hold the write lock
+func (s *memoryStore) expire(key string) {
+	if t, ok := s.expires[key]; ok && !time.Now().Before(t) {
+		s.delete(key)
+	}
+}
+
+func (s *memoryStore) delete(key string) {
+	delete(s.counters, key)
+	delete(s.sets, key)
+	delete(s.zsets, key)
+	delete(s.hashes, key)
+	delete(s.expires, key)
+}
+
+// Whether a key expired, callers hold a lock
+func (s *memoryStore) expired(key string) bool {
+	t, ok := s.expires[key]
+	return ok && !time.Now().Before(t)
+}
+
+func (s *memoryStore) Update(fn func(b Batch)) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if time.Since(s.swept) > MEMORY_SWEEP_INTERVAL {
+		for key := range s.expires {
+			s.expire(key)
+		}
+		s.swept = time.Now()
+	}
+
+	fn(&memoryBatch{s})
+	return nil
+}
+
+type memoryBatch struct {
+	s *memoryStore
+}
+
+func (b *memoryBatch) Incr(key string) {
+	b.s.expire(key)
+	b.s.counters[key]++
+}
+
+func (b *memoryBatch) SAdd(key, member string) {
+	b.s.expire(key)
+	if b.s.sets[key] == nil {
+		b.s.sets[key] = make(map[string]bool)
+	}
+	b.s.sets[key][member] = true
+}
+
+func (b *memoryBatch) ZIncr(key, member string) {
+	b.s.expire(key)
+	if b.s.zsets[key] == nil {
+		b.s.zsets[key] = make(map[string]int64)
+	}
+	b.s.zsets[key][member]++
+}
+
+func (b *memoryBatch) hash(key string) map[string]string {
+	b.s.expire(key)
+	if b.s.hashes[key] == nil {
+		b.s.hashes[key] = make(map[string]string)
+	}
+	return b.s.hashes[key]
+}
+
+func (b *memoryBatch) HSet(key, field, value string) {
+	b.hash(key)[field] = value
+}
+
+func (b *memoryBatch) HSetNX(key, field, value string) {
+	hash := b.hash(key)
+	if _, exists := hash[field]; !exists {
+		hash[field] = value
+	}
+}
+
+func (b *memoryBatch) HIncr(key, field string) {
+	hash := b.hash(key)
+	n, _ := strconv.ParseInt(hash[field], 10, 64)
+	hash[field] = strconv.FormatInt(n+1, 10)
+}
+
+func (b *memoryBatch) ExpireAt(key string, t time.Time) {
+	b.s.expires[key] = t
+}
+
+func (s *memoryStore) Get(key string) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.expired(key) {
+		return 0, nil
+	}
+	return s.counters[key], nil
+}
+
+func (s *memoryStore) MGet(keys ...string) ([]int64, error) {
+	counts := make([]int64, len(keys))
+	for i, key := range keys {
+		counts[i], _ = s.Get(key)
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) SCard(key string) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.expired(key) {
+		return 0, nil
+	}
+	return int64(len(s.sets[key])), nil
+}
+
+func (s *memoryStore) HGetAll(key string) (map[string]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	fields := make(map[string]string)
+	if !s.expired(key) {
+		for field, value := range s.hashes[key] {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+// Returns a sorted set's members from the highest score, callers hold a lock
+func (s *memoryStore) zrevrange(key string) []Entry {
+	if s.expired(key) {
+		return nil
+	}
+
+	members := make([]Entry, 0, len(s.zsets[key]))
+	for member, score := range s.zsets[key] {
+		members = append(members, Entry{ID: member, Count: score})
+	}
+	sort.Sort(byCountDesc(members))
+	return members
+}
+
+func (s *memoryStore) ZRevRange(key string, start, stop int64) ([]Entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return sliceRange(s.zrevrange(key), start, stop), nil
+}
+
+func (s *memoryStore) ZRevRank(key, member string) (int64, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for i, entry := range s.zrevrange(key) {
+		if entry.ID == member {
+			return int64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (s *memoryStore) ZScore(key, member string) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.expired(key) {
+		return 0, nil
+	}
+	return s.zsets[key][member], nil
+}
+
+func (s *memoryStore) Dump(fn func(r *Record) error) error {
+	s.RLock()
+	records := make([]*Record, 0)
+	add := func(key, kind string) *Record {
+		r := &Record{Key: key, Kind: kind, Expires: s.expires[key]}
+		records = append(records, r)
+		return r
+	}
+
+	for key, n := range s.counters {
+		if !s.expired(key) && isStatsKey(key) {
+			add(key, KIND_COUNTER).Counter = n
+		}
+	}
+
+	for key, set := range s.sets {
+		if !s.expired(key) && isStatsKey(key) {
+			r := add(key, KIND_SET)
+			for member := range set {
+				r.Members = append(r.Members, member)
+			}
+		}
+	}
+
+	for key, zset := range s.zsets {
+		if !s.expired(key) && isStatsKey(key) {
+			r := add(key, KIND_ZSET)
+			r.Scores = make(map[string]int64, len(zset))
+			for member, score := range zset {
+				r.Scores[member] = score
+			}
+		}
+	}
+
+	for key, hash := range s.hashes {
+		if !s.expired(key) && isStatsKey(key) {
+			r := add(key, KIND_HASH)
+			r.Fields = make(map[string]string, len(hash))
+			for field, value := range hash {
+				r.Fields[field] = value
+			}
+		}
+	}
+	s.RUnlock()
+
+	// Call fn without the lock, so it can write to this store
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Restore(r *Record) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.delete(r.Key)
+	switch r.Kind {
+	case KIND_COUNTER:
+		s.counters[r.Key] = r.Counter
+	case KIND_SET:
+		s.sets[r.Key] = make(map[string]bool, len(r.Members))
+		for _, member := range r.Members {
+			s.sets[r.Key][member] = true
+		}
+	case KIND_ZSET:
+		s.zsets[r.Key] = make(map[string]int64, len(r.Scores))
+		for member, score := range r.Scores {
+			s.zsets[r.Key][member] = score
+		}
+	case KIND_HASH:
+		s.hashes[r.Key] = make(map[string]string, len(r.Fields))
+		for field, value := range r.Fields {
+			s.hashes[r.Key][field] = value
+		}
+	}
+
+	if !r.Expires.IsZero() {
+		s.expires[r.Key] = r.Expires
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// Orders entries like redis orders a sorted set from the highest score, ties
+// in reverse lexicographic order
+type byCountDesc []Entry
+
+func (e byCountDesc) Len() int      { return len(e) }
+func (e byCountDesc) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byCountDesc) Less(i, j int) bool {
+	if e[i].Count != e[j].Count {
+		return e[i].Count > e[j].Count
+	}
+	return e[i].ID > e[j].ID
+}
+
+// Returns entries from start to stop inclusive, negative indexes count from the
+// end like they do in redis
+func sliceRange(entries []Entry, start, stop int64) []Entry {
+	n := int64(len(entries))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	if start > stop {
+		return []Entry{}
+	}
+	return entries[start : stop+1]
+}
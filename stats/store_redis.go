@@ -0,0 +1,225 @@
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Keys read per SCAN call while dumping
+const REDIS_SCAN_COUNT = 1000
+
+// redisStore keeps stats in redis, where every key is the native type
+type redisStore struct {
+	rcli *redis.Client
+
+	// Whether we opened the client, and close it with the store
+	owned bool
+}
+
+// Returns a store keeping stats in redis through rcli, which is left open
+// when the store is closed
+func NewRedisStore(rcli *redis.Client) Store {
+	return &redisStore{rcli: rcli}
+}
+
+type redisBatch struct {
+	pipe *redis.Pipeline
+}
+
+func (b *redisBatch) Incr(key string)                  { b.pipe.Incr(key) }
+func (b *redisBatch) SAdd(key, member string)          { b.pipe.SAdd(key, member) }
+func (b *redisBatch) ZIncr(key, member string)         { b.pipe.ZIncrBy(key, 1, member) }
+func (b *redisBatch) HSet(key, field, value string)    { b.pipe.HSet(key, field, value) }
+func (b *redisBatch) HSetNX(key, field, value string)  { b.pipe.HSetNX(key, field, value) }
+func (b *redisBatch) HIncr(key, field string)          { b.pipe.HIncrBy(key, field, 1) }
+func (b *redisBatch) ExpireAt(key string, t time.Time) { b.pipe.ExpireAt(key, t) }
+
+func (s *redisStore) Update(fn func(b Batch)) error {
+	_, err := s.rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		fn(&redisBatch{pipe})
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Get(key string) (int64, error) {
+	n, err := s.rcli.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *redisStore) MGet(keys ...string) ([]int64, error) {
+	values, err := s.rcli.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		if v, ok := value.(string); ok {
+			counts[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return counts, nil
+}
+
+func (s *redisStore) SCard(key string) (int64, error) {
+	return s.rcli.SCard(key).Result()
+}
+
+func (s *redisStore) HGetAll(key string) (map[string]string, error) {
+	return s.rcli.HGetAllMap(key).Result()
+}
+
+func (s *redisStore) ZRevRange(key string, start, stop int64) ([]Entry, error) {
+	members, err := s.rcli.ZRevRangeWithScores(key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	return entries(members), nil
+}
+
+func (s *redisStore) ZRevRank(key, member string) (int64, bool, error) {
+	rank, err := s.rcli.ZRevRank(key, member).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	return rank, err == nil, err
+}
+
+func (s *redisStore) ZScore(key, member string) (int64, error) {
+	score, err := s.rcli.ZScore(key, member).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int64(score), err
+}
+
+func (s *redisStore) Dump(fn func(r *Record) error) error {
+	for _, pattern := range STATS_PATTERNS {
+		var cursor int64
+		for {
+			next, keys, err := s.rcli.Scan(cursor, pattern, REDIS_SCAN_COUNT).Result()
+			if err != nil {
+				return err
+			}
+
+			for _, key := range keys {
+				r, err := s.dumpKey(key)
+				if err != nil {
+					return err
+				}
+
+				// Keys can expire between the scan and reading them
+				if r == nil {
+					continue
+				}
+
+				if err := fn(r); err != nil {
+					return err
+				}
+			}
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Reads a key into a record, nil if it no longer exists
+func (s *redisStore) dumpKey(key string) (*Record, error) {
+	kind, err := s.rcli.Type(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{Key: key}
+	switch kind {
+	case "none":
+		return nil, nil
+	case "string":
+		r.Kind = KIND_COUNTER
+		r.Counter, err = s.Get(key)
+	case "set":
+		r.Kind = KIND_SET
+		r.Members, err = s.rcli.SMembers(key).Result()
+	case "zset":
+		var members []Entry
+		members, err = s.ZRevRange(key, 0, -1)
+		r.Kind, r.Scores = KIND_ZSET, make(map[string]int64, len(members))
+		for _, member := range members {
+			r.Scores[member.ID] = member.Count
+		}
+	case "hash":
+		r.Kind = KIND_HASH
+		r.Fields, err = s.HGetAll(key)
+	default:
+		return nil, fmt.Errorf("%s holds a %s, which isn't a stats type", key, kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := s.rcli.PTTL(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		r.Expires = time.Now().Add(ttl)
+	}
+	return r, nil
+}
+
+func (s *redisStore) Restore(r *Record) error {
+	_, err := s.rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.Del(r.Key)
+
+		switch r.Kind {
+		case KIND_COUNTER:
+			pipe.IncrBy(r.Key, r.Counter)
+		case KIND_SET:
+			if len(r.Members) > 0 {
+				pipe.SAdd(r.Key, r.Members...)
+			}
+		case KIND_ZSET:
+			for member, score := range r.Scores {
+				pipe.ZIncrBy(r.Key, float64(score), member)
+			}
+		case KIND_HASH:
+			for field, value := range r.Fields {
+				pipe.HSet(r.Key, field, value)
+			}
+		}
+
+		if !r.Expires.IsZero() {
+			pipe.ExpireAt(r.Key, r.Expires)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Close() error {
+	if s.owned {
+		return s.rcli.Close()
+	}
+	return nil
+}
+
+func entries(members []redis.Z) []Entry {
+	result := make([]Entry, 0, len(members))
+	for _, member := range members {
+		result = append(result, Entry{ID: fmt.Sprint(member.Member), Count: int64(member.Score)})
+	}
+	return result
+}
@@ -0,0 +1,208 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens an empty store of a kind, and a func to clean it up
+func openTestStore(t *testing.T, kind string) (Store, func()) {
+	if kind == "memory" {
+		return NewMemoryStore(), func() {}
+	}
+
+	dir, err := ioutil.TempDir("", "airhorn-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewBoltStore(filepath.Join(dir, "stats.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+var testStoreKinds = []string{"memory", "bolt"}
+
+// Writes one key of every kind, one of them expiring at expires, and a key
+// that isn't a stat
+func fillTestStore(t *testing.T, store Store, expires time.Time) {
+	err := store.Update(func(b Batch) {
+		b.Incr("airhorn:total")
+		b.Incr("airhorn:total")
+		b.SAdd("airhorn:a:users", "1")
+		b.SAdd("airhorn:a:users", "2")
+		b.ZIncr("airhorn:lb:users:all", "1")
+		b.ZIncr("airhorn:lb:users:all", "1")
+		b.ZIncr("airhorn:lb:users:all", "2")
+		b.HSetNX("airhorn:user:1", "first", "100")
+		b.HSetNX("airhorn:user:1", "first", "200")
+		b.HSet("airhorn:user:1", "last", "200")
+		b.HIncr("airhorn:user:1", "forced")
+		b.Incr("airhorn:ts:m:total:1")
+		b.ExpireAt("airhorn:ts:m:total:1", expires)
+		b.HSet("airhorn:guild:1:settings", "prefix", "!")
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Formats a record so records from different stores can be compared
+func formatRecord(r *Record) string {
+	parts := []string{r.Kind}
+	switch r.Kind {
+	case KIND_COUNTER:
+		parts = append(parts, fmt.Sprint(r.Counter))
+	case KIND_SET:
+		members := append([]string{}, r.Members...)
+		sort.Strings(members)
+		parts = append(parts, members...)
+	case KIND_ZSET:
+		for member, score := range r.Scores {
+			parts = append(parts, fmt.Sprintf("%s=%d", member, score))
+		}
+	case KIND_HASH:
+		for field, value := range r.Fields {
+			parts = append(parts, fmt.Sprintf("%s=%s", field, value))
+		}
+	}
+	sort.Strings(parts[1:])
+
+	if !r.Expires.IsZero() {
+		parts = append(parts, "expires "+fmt.Sprint(r.Expires.UnixNano()))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Returns every record a store dumps, formatted, by key
+func dumpTestStore(t *testing.T, store Store) map[string]string {
+	records := make(map[string]string)
+	err := store.Dump(func(r *Record) error {
+		records[r.Key] = formatRecord(r)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestStoreDump(t *testing.T) {
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	expected := map[string]string{
+		"airhorn:total":        "counter 2",
+		"airhorn:a:users":      "set 1 2",
+		"airhorn:lb:users:all": "zset 1=2 2=1",
+		"airhorn:user:1":       "hash first=100 forced=1 last=200",
+		"airhorn:ts:m:total:1": fmt.Sprintf("counter 1 expires %d", expires.UnixNano()),
+	}
+
+	for _, kind := range testStoreKinds {
+		store, cleanup := openTestStore(t, kind)
+		fillTestStore(t, store, expires)
+
+		records := dumpTestStore(t, store)
+		if len(records) != len(expected) {
+			t.Errorf("%s: dumped %d keys, expected %d: %v", kind, len(records), len(expected), records)
+		}
+
+		for key, record := range expected {
+			if records[key] != record {
+				t.Errorf("%s: %s dumped as %q, expected %q", kind, key, records[key], record)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestStoreMigrate(t *testing.T) {
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	for _, fromKind := range testStoreKinds {
+		for _, toKind := range testStoreKinds {
+			from, cleanupFrom := openTestStore(t, fromKind)
+			to, cleanupTo := openTestStore(t, toKind)
+			fillTestStore(t, from, expires)
+
+			// Keys already in the target are replaced
+			to.Update(func(b Batch) {
+				b.Incr("airhorn:total")
+				b.SAdd("airhorn:a:users", "3")
+			})
+
+			n, err := Migrate(from, to)
+			if err != nil {
+				t.Fatalf("%s to %s: %s", fromKind, toKind, err)
+			}
+
+			expected := dumpTestStore(t, from)
+			if n != len(expected) {
+				t.Errorf("%s to %s: copied %d keys, expected %d", fromKind, toKind, n, len(expected))
+			}
+
+			records := dumpTestStore(t, to)
+			for key, record := range expected {
+				if records[key] != record {
+					t.Errorf("%s to %s: %s restored as %q, expected %q", fromKind, toKind, key, records[key], record)
+				}
+			}
+
+			if count, _ := to.SCard("airhorn:a:users"); count != 2 {
+				t.Errorf("%s to %s: restored set has %d members, expected 2", fromKind, toKind, count)
+			}
+
+			cleanupFrom()
+			cleanupTo()
+		}
+	}
+}
+
+func TestStoreExpireAt(t *testing.T) {
+	for _, kind := range testStoreKinds {
+		store, cleanup := openTestStore(t, kind)
+		fillTestStore(t, store, time.Now().Add(50*time.Millisecond))
+
+		if n, _ := store.Get("airhorn:ts:m:total:1"); n != 1 {
+			t.Errorf("%s: counter is %d before it expires, expected 1", kind, n)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if n, _ := store.Get("airhorn:ts:m:total:1"); n != 0 {
+			t.Errorf("%s: counter is %d after it expired, expected 0", kind, n)
+		}
+
+		if _, exists := dumpTestStore(t, store)["airhorn:ts:m:total:1"]; exists {
+			t.Errorf("%s: expired key was dumped", kind)
+		}
+
+		// Writing to an expired key starts it over without an expiry
+		store.Update(func(b Batch) { b.Incr("airhorn:ts:m:total:1") })
+		if n, _ := store.Get("airhorn:ts:m:total:1"); n != 1 {
+			t.Errorf("%s: counter is %d after starting over, expected 1", kind, n)
+		}
+
+		if record := dumpTestStore(t, store)["airhorn:ts:m:total:1"]; record != "counter 1" {
+			t.Errorf("%s: restarted key dumped as %q, expected %q", kind, record, "counter 1")
+		}
+
+		// Keys that aren't stats are never dumped, but are still there
+		if fields, _ := store.HGetAll("airhorn:guild:1:settings"); fields["prefix"] != "!" {
+			t.Errorf("%s: lost a key that isn't a stat", kind)
+		}
+		cleanup()
+	}
+}
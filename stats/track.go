@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+// PlayRecord is everything the stats need to know about one play
+type PlayRecord struct {
+	Time       time.Time
+	GuildID    string
+	ChannelID  string
+	UserID     string
+	Collection string
+	Sound      string
+	Priority   string
+
+	// Whether the user picked the sound, rather than getting one at random
+	Forced bool
+}
+
+// Counts a play in every stat, in one batch
+func Track(store Store, p *PlayRecord) error {
+	return store.Update(func(b Batch) {
+		base := "airhorn:a"
+		if p.Forced {
+			base = "airhorn:f"
+		}
+
+		b.Incr("airhorn:total")
+		b.Incr(fmt.Sprintf("%s:total", base))
+		b.Incr(fmt.Sprintf("%s:sound:%s", base, p.Sound))
+		b.Incr(fmt.Sprintf("%s:priority:%s", base, p.Priority))
+		b.Incr(fmt.Sprintf("%s:user:%s:sound:%s", base, p.UserID, p.Sound))
+		b.Incr(fmt.Sprintf("%s:guild:%s:sound:%s", base, p.GuildID, p.Sound))
+		b.Incr(fmt.Sprintf("%s:guild:%s:chan:%s:sound:%s", base, p.GuildID, p.ChannelID, p.Sound))
+		b.SAdd(fmt.Sprintf("%s:users", base), p.UserID)
+		b.SAdd(fmt.Sprintf("%s:guilds", base), p.GuildID)
+		b.SAdd(fmt.Sprintf("%s:channels", base), p.ChannelID)
+
+		trackSeries(b, p.Time, p.Sound, p.GuildID)
+		trackLeaderboards(b, p.Time, p.UserID, p.GuildID, p.Sound)
+		trackUser(b, p.Time, p.UserID, p.Collection+"/"+p.Sound, p.Forced)
+	})
+}
+
+// Counts are the headline numbers of random plays shown on the website
+type Counts struct {
+	Total    int64
+	Users    int64
+	Guilds   int64
+	Channels int64
+
+	// Plays of the truck horn, which the website keeps a secret
+	Secret int64
+}
+
+func LoadCounts(store Store) (*Counts, error) {
+	var err error
+	counts := &Counts{}
+
+	if counts.Total, err = store.Get("airhorn:a:total"); err != nil {
+		return nil, err
+	}
+
+	if counts.Users, err = store.SCard("airhorn:a:users"); err != nil {
+		return nil, err
+	}
+
+	if counts.Guilds, err = store.SCard("airhorn:a:guilds"); err != nil {
+		return nil, err
+	}
+
+	if counts.Channels, err = store.SCard("airhorn:a:channels"); err != nil {
+		return nil, err
+	}
+
+	if counts.Secret, err = store.Get("airhorn:a:sound:truck"); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
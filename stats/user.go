@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"strconv"
+	"time"
+)
+
+// UserStats is what's known about one user's plays, across every guild.
+// Sounds are named <collection prefix>/<sound name>.
+type UserStats struct {
+	Forced int64 `json:"forced"`
+	Random int64 `json:"random"`
+
+	// Zero if the user never played anything
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	// Every sound the user played, most played first
+	Sounds []Entry `json:"sounds"`
+
+	// Sounds the user got at random, most played first
+	RandomSounds []Entry `json:"random_sounds"`
+}
+
+func (u *UserStats) Total() int64 {
+	return u.Forced + u.Random
+}
+
+// The user's counters and first and last play times
+func userKey(userID string) string {
+	return "airhorn:user:" + userID
+}
+
+// The user's sounds by plays
+func userSoundsKey(userID string) string {
+	return "airhorn:user:" + userID + ":sounds"
+}
+
+// The user's randomly picked sounds by plays
+func userRandomKey(userID string) string {
+	return "airhorn:user:" + userID + ":random"
+}
+
+// Counts a play of sound by a user at time t, as part of the batch the rest
+// of the play's stats use
+func trackUser(b Batch, t time.Time, userID, sound string, forced bool) {
+	at := strconv.FormatInt(t.Unix(), 10)
+	b.HSetNX(userKey(userID), "first", at)
+	b.HSet(userKey(userID), "last", at)
+	b.ZIncr(userSoundsKey(userID), sound)
+
+	if forced {
+		b.HIncr(userKey(userID), "forced")
+	} else {
+		b.HIncr(userKey(userID), "random")
+		b.ZIncr(userRandomKey(userID), sound)
+	}
+}
+
+// Loads a user's stats, a user that never played anything has all zeroes
+func LoadUser(store Store, userID string) (*UserStats, error) {
+	counts, err := store.HGetAll(userKey(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	user := &UserStats{}
+	user.Sounds, err = store.ZRevRange(userSoundsKey(userID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	user.RandomSounds, err = store.ZRevRange(userRandomKey(userID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Forced, _ = strconv.ParseInt(counts["forced"], 10, 64)
+	user.Random, _ = strconv.ParseInt(counts["random"], 10, 64)
+
+	if first, err := strconv.ParseInt(counts["first"], 10, 64); err == nil {
+		user.First = time.Unix(first, 0)
+	}
+
+	if last, err := strconv.ParseInt(counts["last"], 10, 64); err == nil {
+		user.Last = time.Unix(last, 0)
+	}
+	return user, nil
+}
+
+// Returns the 1-based rank and plays of a member of a board for the current
+// period, a rank of 0 if the member isn't on it
+func Rank(store Store, period *Period, board, member string) (int64, int64, error) {
+	key := period.Key(board, time.Now())
+
+	rank, found, err := store.ZRevRank(key, member)
+	if err != nil || !found {
+		return 0, 0, err
+	}
+
+	score, err := store.ZScore(key, member)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rank + 1, score, nil
+}
@@ -0,0 +1,53 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackUser(t *testing.T) {
+	first, last := time.Unix(1000, 0), time.Unix(2000, 0)
+	plays := []*PlayRecord{
+		{Time: first, GuildID: "10", ChannelID: "20", UserID: "1", Collection: "airhorn", Sound: "default", Forced: true},
+		{Time: time.Unix(1500, 0), GuildID: "10", ChannelID: "20", UserID: "1", Collection: "airhorn", Sound: "echo"},
+		{Time: last, GuildID: "10", ChannelID: "20", UserID: "1", Collection: "airhorn", Sound: "echo"},
+		{Time: last, GuildID: "10", ChannelID: "20", UserID: "2", Collection: "cena", Sound: "airhorn"},
+	}
+
+	for _, kind := range testStoreKinds {
+		store, cleanup := openTestStore(t, kind)
+		for _, play := range plays {
+			if err := Track(store, play); err != nil {
+				t.Fatalf("%s: %s", kind, err)
+			}
+		}
+
+		user, err := LoadUser(store, "1")
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+
+		if user.Forced != 1 || user.Random != 2 {
+			t.Errorf("%s: user has %d forced and %d random plays, expected 1 and 2", kind, user.Forced, user.Random)
+		}
+
+		if !user.First.Equal(first) || !user.Last.Equal(last) {
+			t.Errorf("%s: user played first at %s and last at %s, expected %s and %s", kind, user.First, user.Last, first, last)
+		}
+
+		if len(user.Sounds) != 2 || user.Sounds[0].ID != "airhorn/echo" || user.Sounds[0].Count != 2 {
+			t.Errorf("%s: user sounds are %v, expected airhorn/echo first with 2 plays", kind, user.Sounds)
+		}
+
+		if len(user.RandomSounds) != 1 || user.RandomSounds[0].ID != "airhorn/echo" {
+			t.Errorf("%s: user random sounds are %v, expected only airhorn/echo", kind, user.RandomSounds)
+		}
+
+		// Users that never played anything have no stats
+		nobody, err := LoadUser(store, "3")
+		if err != nil || nobody.Total() != 0 || !nobody.First.IsZero() {
+			t.Errorf("%s: user with no plays loaded as %v (%v)", kind, nobody, err)
+		}
+		cleanup()
+	}
+}